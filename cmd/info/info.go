@@ -3,12 +3,10 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"crypto/md5"
-	"encoding/hex"
 	"flag"
-	"fmt"
 	"html/template"
 	"log"
+	"sort"
 	"strings"
 
 	"github.com/Catofes/RAIT/v4/pkg/misc"
@@ -35,30 +33,33 @@ type peerInfo struct {
 }
 
 func (s *app) get(ctx echo.Context) error {
-	peers, err := rait.NewPeers(s.url, "", nil)
+	peers, err := rait.NewPeers([]string{s.url}, misc.Cache{}, nil, nil, nil)
 	if err != nil {
 		ctx.Error(err)
 		return err
 	}
+	// the records of a node, e.g. one per address family, share its route id
 	infos := make(map[string]peerInfo, 0)
 	for _, peer := range peers {
-		if _, ok := infos[s.generateRouteID(peer)]; !ok {
-			infos[s.generateRouteID(peer)] = peerInfo{}
+		info := infos[peer.RouteID()]
+		if peer.Name != "" {
+			info.Name = peer.Name
 		}
-		info := infos[s.generateRouteID(peer)]
-		info.Name = peer.Name
-		info.RouteID = s.generateRouteID(peer)
-		peer.GenerateInnerAddress().String()
-		switch peer.Endpoint.AddressFamily {
-		case "ip4":
-			info.Wg4Address = peer.Endpoint.InnerAddress
-			info.Vxlan4Address = misc.NewLLAddrFromMac(peer.GenerateMac()).String()
-		case "ip6":
-			info.Wg6Address = peer.Endpoint.InnerAddress
-			info.Vxlan6Address = misc.NewLLAddrFromMac(peer.GenerateMac()).String()
+		info.RouteID = peer.RouteID()
+		for i := range peer.Endpoint {
+			endpoint := &peer.Endpoint[i]
+			endpoint.GenerateInnerAddress(peer.PublicKey)
+			switch endpoint.AddressFamily {
+			case "ip4":
+				info.Wg4Address = endpoint.InnerAddress
+				info.Vxlan4Address = misc.NewLLAddrFromMac(endpoint.GenerateMac(peer.PublicKey)).String()
+			case "ip6":
+				info.Wg6Address = endpoint.InnerAddress
+				info.Vxlan6Address = misc.NewLLAddrFromMac(endpoint.GenerateMac(peer.PublicKey)).String()
+			}
 		}
 		info.AnnouncedAddress = make([]string, 0)
-		infos[s.generateRouteID(peer)] = info
+		infos[peer.RouteID()] = info
 	}
 	babel := rait.Babeld{
 		SocketType: "unix",
@@ -81,7 +82,7 @@ func (s *app) get(ctx echo.Context) error {
 		}
 	}
 
-	data := make(map[string]peerInfo)
+	data := make([]peerInfo, 0, len(infos))
 	for _, v := range infos {
 		if v.Vxlan4Address == "" {
 			v.Vxlan4Address = "-"
@@ -95,8 +96,14 @@ func (s *app) get(ctx echo.Context) error {
 		if v.Wg6Address == "" {
 			v.Wg6Address = "-"
 		}
-		data[v.Name] = v
+		data = append(data, v)
 	}
+	sort.Slice(data, func(i, j int) bool {
+		if data[i].Name != data[j].Name {
+			return data[i].Name < data[j].Name
+		}
+		return data[i].RouteID < data[j].RouteID
+	})
 
 	t := template.Must(template.New("").Parse(`
 <html>
@@ -138,13 +145,6 @@ func (s *app) get(ctx echo.Context) error {
 	return nil
 }
 
-func (s *app) generateRouteID(peer rait.Peer) string {
-	hash := md5.Sum([]byte(peer.PublicKey + "\n"))
-	id := hex.EncodeToString(hash[:])
-	return fmt.Sprintf("%s:%s:%s:%s:%s:%s:%s:%s",
-		id[0:2], id[2:4], id[4:6], id[6:8], id[8:10], id[10:12], id[12:14], id[14:16])
-}
-
 func (s *app) run() {
 	e := echo.New()
 	e.Use(middleware.Logger())
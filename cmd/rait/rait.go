@@ -1,15 +1,19 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/Catofes/RAIT/v4/pkg/misc"
 	"github.com/Catofes/RAIT/v4/pkg/rait"
+	"github.com/Catofes/RAIT/v4/pkg/registry"
 
-	"github.com/hashicorp/hcl/v2"
 	"github.com/urfave/cli/v2"
+	"github.com/zclconf/go-cty/cty"
 	"go.uber.org/zap"
 )
 
@@ -29,6 +33,10 @@ var commonFlags = []cli.Flag{
 		Aliases: []string{"d"},
 		Value:   false,
 	},
+	&cli.StringSliceFlag{
+		Name:  "var",
+		Usage: "set variable in rait.conf, in the form of NAME=VALUE",
+	},
 	&cli.BoolFlag{
 		Name:    "bind",
 		Usage:   "enable wireguard bind support",
@@ -38,7 +46,27 @@ var commonFlags = []cli.Flag{
 }
 
 var commonBeforeFunc = func(ctx *cli.Context) error {
+	if err := loggerBeforeFunc(ctx); err != nil {
+		return err
+	}
+
+	var err error
+	r, err = rait.NewRAIT(ctx.String("config"))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+var loggerBeforeFunc = func(ctx *cli.Context) error {
 	misc.Bind = ctx.Bool("bind")
+	for _, v := range ctx.StringSlice("var") {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid variable %s, expecting NAME=VALUE", v)
+		}
+		misc.Variables[kv[0]] = kv[1]
+	}
 
 	config := zap.NewDevelopmentConfig()
 	config.DisableStacktrace = true
@@ -54,12 +82,46 @@ var commonBeforeFunc = func(ctx *cli.Context) error {
 		return err
 	}
 	zap.ReplaceGlobals(logger)
+	return nil
+}
 
-	r, err = rait.NewRAIT(ctx.String("config"))
+var jsonFlag = &cli.BoolFlag{
+	Name:    "json",
+	Usage:   "print the result as json",
+	Aliases: []string{"j"},
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func migrate(ctx *cli.Context, convert func(src string) ([]byte, []string, error)) error {
+	if ctx.Args().Len() != 2 {
+		return fmt.Errorf("expecting 2 arguments: SRC DEST")
+	}
+	data, warnings, err := convert(ctx.Args().Get(0))
 	if err != nil {
 		return err
 	}
-	return nil
+	for _, warning := range warnings {
+		zap.S().Warn(warning)
+	}
+	w, err := misc.NewWriteCloser(ctx.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	_, err = w.Write(data)
+	return err
 }
 
 func main() {
@@ -106,39 +168,470 @@ func main() {
 		}, {
 			Name:      "pub",
 			Aliases:   []string{"p"},
-			Usage:     "generate public metadata",
-			UsageText: "rait pub [options] DEST",
-			Flags:     commonFlags,
+			Usage:     "generate public metadata, or push it to a registry",
+			UsageText: "rait pub [options] DEST\n   rait pub [options] --push URL",
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{
+					Name:  "push",
+					Usage: "url of the registry endpoint to submit the node record to, e.g. https://registry.example/nodes",
+				},
+				&cli.StringFlag{
+					Name:    "token-file",
+					Usage:   "file containing the bearer token of the registry",
+					EnvVars: []string{"RAIT_REGISTRY_TOKEN_FILE"},
+				},
+				&cli.StringFlag{
+					Name:  "method",
+					Usage: "http method of the push, PUT or POST",
+					Value: "PUT",
+				},
+				&cli.StringFlag{
+					Name:  "state",
+					Usage: "file keeping the hash of the last record pushed, an unchanged record is not pushed again",
+					Value: "/var/lib/rait/push.state",
+				},
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "push the record even if unchanged",
+				},
+			}, commonFlags...),
+			Before: commonBeforeFunc,
+			Action: func(ctx *cli.Context) error {
+				if ctx.String("push") == "" {
+					if ctx.Args().Len() != 1 {
+						return fmt.Errorf("expecting 1 argument: DEST")
+					}
+					return r.PublicConf(ctx.Args().First())
+				}
+				if ctx.Args().Len() != 0 {
+					return fmt.Errorf("expecting no argument with --push")
+				}
+				method := strings.ToUpper(ctx.String("method"))
+				if method != "PUT" && method != "POST" {
+					return fmt.Errorf("invalid method %s, expecting PUT or POST", ctx.String("method"))
+				}
+				token, err := misc.Secret{File: ctx.String("token-file")}.Resolve()
+				if err != nil {
+					return fmt.Errorf("failed to read registry token: %s", err)
+				}
+				record, err := r.PublicRecord()
+				if err != nil {
+					return err
+				}
+				client := &registry.Client{URL: ctx.String("push"), Token: token, Method: method, State: ctx.String("state")}
+				verdicts, err := client.Push(record, ctx.Bool("force"))
+				if err != nil {
+					return err
+				}
+				if verdicts == nil {
+					fmt.Println("node record unchanged since the last push, skipped")
+				}
+				for _, verdict := range verdicts {
+					approval := "approved"
+					if !verdict.Approved {
+						approval = "pending approval"
+					}
+					fmt.Printf("%s %s: %s, %s\n", orDash(verdict.Name), verdict.PublicKey, verdict.Status, approval)
+				}
+				return nil
+			},
+		}, {
+			Name:      "check",
+			Aliases:   []string{"c"},
+			Usage:     "validate rait.conf and the peer list",
+			UsageText: "rait check [options]",
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{
+					Name:    "peers",
+					Usage:   "path to peer list, overriding the one in rait.conf",
+					Aliases: []string{"p"},
+				},
+			}, commonFlags...),
+			Before: loggerBeforeFunc,
+			Action: func(ctx *cli.Context) error {
+				diags := rait.Check(ctx.String("config"), ctx.String("peers"))
+				for _, diag := range diags {
+					fmt.Fprintln(os.Stderr, misc.FormatDiagnostic(diag))
+				}
+				if diags.HasErrors() {
+					return fmt.Errorf("check failed with %d error(s)", len(diags.Errs()))
+				}
+				return nil
+			},
+		}, {
+			Name:      "migrate",
+			Aliases:   []string{"m"},
+			Usage:     "convert legacy toml configuration to hcl",
+			UsageText: "rait migrate [command] [options] SRC DEST",
+			Subcommands: []*cli.Command{{
+				Name:      "conf",
+				Aliases:   []string{"c"},
+				Usage:     "convert legacy rait.conf",
+				UsageText: "rait migrate conf [options] SRC DEST",
+				Flags:     commonFlags,
+				Before:    loggerBeforeFunc,
+				Action: func(ctx *cli.Context) error {
+					return migrate(ctx, rait.MigrateConf)
+				},
+			}, {
+				Name:      "peers",
+				Aliases:   []string{"p"},
+				Usage:     "convert legacy peers.conf",
+				UsageText: "rait migrate peers [options] SRC DEST",
+				Flags:     commonFlags,
+				Before:    loggerBeforeFunc,
+				Action: func(ctx *cli.Context) error {
+					return migrate(ctx, rait.MigratePeers)
+				},
+			}},
+		}, {
+			Name:      "registry",
+			Aliases:   []string{"g"},
+			Usage:     "helpers for publishers of peer lists",
+			UsageText: "rait registry [command] [options]",
+			Subcommands: []*cli.Command{{
+				Name:      "keygen",
+				Usage:     "generate a key pair for signing peer lists",
+				UsageText: "rait registry keygen [options] SECKEY PUBKEY",
+				Flags:     commonFlags,
+				Before:    loggerBeforeFunc,
+				Action: func(ctx *cli.Context) error {
+					if ctx.Args().Len() != 2 {
+						return fmt.Errorf("expecting 2 arguments: SECKEY PUBKEY")
+					}
+					secret, public, err := misc.GenerateSigningKey()
+					if err != nil {
+						return err
+					}
+					if err := os.WriteFile(ctx.Args().Get(0), []byte(secret+"\n"), 0600); err != nil {
+						return fmt.Errorf("failed to save secret key: %s", err)
+					}
+					w, err := misc.NewWriteCloser(ctx.Args().Get(1))
+					if err != nil {
+						return err
+					}
+					defer w.Close()
+					_, err = fmt.Fprint(w, public.String())
+					return err
+				},
+			}, {
+				Name:      "sign",
+				Usage:     "sign a peer list, producing a detached signature",
+				UsageText: "rait registry sign [options] SRC [SIG]",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "key",
+						Usage:    "secret key generated by keygen",
+						Aliases:  []string{"k"},
+						Required: true,
+					},
+				}, commonFlags...),
+				Before: loggerBeforeFunc,
+				Action: func(ctx *cli.Context) error {
+					if ctx.Args().Len() < 1 || ctx.Args().Len() > 2 {
+						return fmt.Errorf("expecting 1 or 2 arguments: SRC [SIG]")
+					}
+					src, dest := ctx.Args().Get(0), ctx.Args().Get(1)
+					if dest == "" {
+						dest = src + ".sig"
+					}
+					key, err := misc.ReadAll(ctx.String("key"))
+					if err != nil {
+						return err
+					}
+					data, err := misc.ReadAll(src)
+					if err != nil {
+						return err
+					}
+					sig, err := misc.Sign(string(key), data)
+					if err != nil {
+						return err
+					}
+					w, err := misc.NewWriteCloser(dest)
+					if err != nil {
+						return err
+					}
+					defer w.Close()
+					_, err = w.Write(sig)
+					return err
+				},
+			}, {
+				Name:      "serve",
+				Usage:     "serve a peer list made of the node records submitted over http",
+				UsageText: "rait registry serve [options]",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "listen",
+						Usage:   "address to listen on",
+						Aliases: []string{"l"},
+						Value:   "127.0.0.1:8080",
+					},
+					&cli.StringFlag{
+						Name:    "data",
+						Usage:   "file keeping the node records",
+						Aliases: []string{"f"},
+						Value:   "/var/lib/rait/registry.json",
+					},
+					&cli.StringFlag{
+						Name:     "node-tokens",
+						Usage:    "file of the tokens accepted for submitting node records, one per line",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "admin-tokens",
+						Usage:    "file of the tokens accepted for the admin endpoints, one per line",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "key",
+						Usage:   "secret key generated by keygen, to sign the peer list with",
+						Aliases: []string{"k"},
+					},
+					&cli.BoolFlag{
+						Name:  "auto-approve",
+						Usage: "approve the nodes submitted for the first time right away",
+					},
+				}, commonFlags...),
+				Before: loggerBeforeFunc,
+				Action: func(ctx *cli.Context) error {
+					var err error
+					s := &registry.Server{}
+					if s.Registry, err = registry.Open(ctx.String("data"), ctx.Bool("auto-approve")); err != nil {
+						return err
+					}
+					if s.NodeTokens, err = registry.ReadTokens(ctx.String("node-tokens")); err != nil {
+						return err
+					}
+					if s.AdminTokens, err = registry.ReadTokens(ctx.String("admin-tokens")); err != nil {
+						return err
+					}
+					if ctx.String("key") != "" {
+						key, err := misc.ReadAll(ctx.String("key"))
+						if err != nil {
+							return err
+						}
+						s.SigningKey = string(key)
+					}
+					return s.ListenAndServe(ctx.String("listen"))
+				},
+			}, {
+				Name:      "lint",
+				Usage:     "check peer lists for duplicate keys and names, and colliding mac or inner addresses",
+				UsageText: "rait registry lint [options] SRC...",
+				Flags:     commonFlags,
+				Before:    loggerBeforeFunc,
+				Action: func(ctx *cli.Context) error {
+					if ctx.Args().Len() < 1 {
+						return fmt.Errorf("expecting at least 1 argument: SRC...")
+					}
+					diags := rait.LintPeers(ctx.Args().Slice())
+					for _, diag := range diags {
+						fmt.Fprintln(os.Stderr, misc.FormatDiagnostic(diag))
+					}
+					if diags.HasErrors() {
+						return fmt.Errorf("lint failed with %d error(s)", len(diags.Errs()))
+					}
+					return nil
+				},
+			}},
+		}, {
+			Name:      "peers",
+			Usage:     "inspect the peers derived from the peer lists",
+			UsageText: "rait peers [command] [options]",
+			Subcommands: []*cli.Command{{
+				Name:      "list",
+				Aliases:   []string{"l"},
+				Usage:     "list the peers, one row per endpoint",
+				UsageText: "rait peers list [options]",
+				Flags:     append([]cli.Flag{jsonFlag}, commonFlags...),
+				Before:    commonBeforeFunc,
+				Action: func(ctx *cli.Context) error {
+					infos, err := r.InspectPeers()
+					if err != nil {
+						return err
+					}
+					if ctx.Bool("json") {
+						return printJSON(infos)
+					}
+					w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+					fmt.Fprintln(w, "NAME\tPUBLIC KEY\tROUTE ID\tSTATUS\tFAMILY\tPORT\tADDRESS\tRESOLVED\tMAC\tINNER ADDRESS")
+					for _, info := range infos {
+						for _, e := range info.Endpoints {
+							fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+								orDash(info.Name), info.PublicKey, info.RouteID, info.Status,
+								e.AddressFamily, e.Port, orDash(e.Address), orDash(e.ResolvedIP), e.Mac, e.InnerAddress)
+						}
+					}
+					return w.Flush()
+				},
+			}, {
+				Name:      "show",
+				Aliases:   []string{"s"},
+				Usage:     "show a peer by name or public key",
+				UsageText: "rait peers show [options] NAME|KEY",
+				Flags:     append([]cli.Flag{jsonFlag}, commonFlags...),
+				Before:    commonBeforeFunc,
+				Action: func(ctx *cli.Context) error {
+					if ctx.Args().Len() != 1 {
+						return fmt.Errorf("expecting 1 argument: NAME|KEY")
+					}
+					infos, err := r.InspectPeers()
+					if err != nil {
+						return err
+					}
+					var found *rait.PeerInfo
+					for i, info := range infos {
+						if info.Name == ctx.Args().First() || info.PublicKey == ctx.Args().First() {
+							found = &infos[i]
+							break
+						}
+					}
+					if found == nil {
+						return fmt.Errorf("peer %s not found", ctx.Args().First())
+					}
+					if ctx.Bool("json") {
+						return printJSON(found)
+					}
+					w := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+					fmt.Fprintf(w, "name:\t%s\n", orDash(found.Name))
+					fmt.Fprintf(w, "public key:\t%s\n", found.PublicKey)
+					fmt.Fprintf(w, "node:\t%s\n", found.Node)
+					for _, info := range infos {
+						if info.Node == found.Node && info.PublicKey != found.PublicKey {
+							fmt.Fprintf(w, "  other key:\t%s (%s)\n", info.PublicKey, info.Status)
+						}
+					}
+					fmt.Fprintf(w, "route id:\t%s\n", found.RouteID)
+					fmt.Fprintf(w, "status:\t%s\n", found.Status)
+					if found.Reason != "" {
+						fmt.Fprintf(w, "reason:\t%s\n", found.Reason)
+					}
+					for _, e := range found.Endpoints {
+						fmt.Fprintf(w, "endpoint %s:\t\n", e.AddressFamily)
+						fmt.Fprintf(w, "  port:\t%d\n", e.Port)
+						fmt.Fprintf(w, "  address:\t%s\n", orDash(e.Address))
+						fmt.Fprintf(w, "  resolved:\t%s\n", orDash(e.ResolvedIP))
+						fmt.Fprintf(w, "  mac:\t%s\n", e.Mac)
+						fmt.Fprintf(w, "  inner address:\t%s\n", e.InnerAddress)
+					}
+					return w.Flush()
+				},
+			}},
+		}, {
+			Name:      "cache",
+			Aliases:   []string{"k"},
+			Usage:     "inspect the cache of the peer lists",
+			UsageText: "rait cache [options]",
+			Flags:     append([]cli.Flag{jsonFlag}, commonFlags...),
 			Before:    commonBeforeFunc,
+			Action: func(ctx *cli.Context) error {
+				sources, err := r.PeerSources()
+				if err != nil {
+					return err
+				}
+				cache, err := r.PeerCache()
+				if err != nil {
+					return err
+				}
+				var infos []*misc.CacheInfo
+				for _, source := range sources {
+					path := cache.For(source, len(sources)).Path
+					info, err := misc.InspectCache(path)
+					if err != nil {
+						zap.S().Debug(err)
+						info = &misc.CacheInfo{Path: path, URL: source}
+					}
+					infos = append(infos, info)
+				}
+				if ctx.Bool("json") {
+					return printJSON(infos)
+				}
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "SOURCE\tCACHE\tFETCHED\tAGE\tSIZE\tSIGNED")
+				for _, info := range infos {
+					fetched, age := "-", "-"
+					if !info.FetchedAt.IsZero() {
+						fetched = info.FetchedAt.Format(time.RFC3339)
+						age = time.Since(info.FetchedAt).Round(time.Second).String()
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%t\n", info.URL, info.Path, fetched, age, info.Size, info.Signed)
+				}
+				return w.Flush()
+			},
+		}, {
+			Name:      "schema",
+			Aliases:   []string{"s"},
+			Usage:     "print json schema of rait.conf or peer list",
+			UsageText: "rait schema [options] conf|peers",
 			Action: func(ctx *cli.Context) error {
 				if ctx.Args().Len() != 1 {
-					return fmt.Errorf("expecting 1 argument: DEST")
+					return fmt.Errorf("expecting 1 argument: conf|peers")
+				}
+				var schema map[string]interface{}
+				switch ctx.Args().First() {
+				case "conf":
+					schema = rait.ConfSchema()
+				case "peers":
+					schema = rait.PeersSchema()
+				default:
+					return fmt.Errorf("unknown schema %s, expecting conf or peers", ctx.Args().First())
 				}
-				return r.PublicConf(ctx.Args().First())
+				return printJSON(schema)
 			},
 		}, {
 			Name:      "remarks",
 			Aliases:   []string{"r"},
-			Usage:     "query remarks from rait.conf",
-			UsageText: "rait query [options] QUERY",
-			Flags:     commonFlags,
-			Before:    commonBeforeFunc,
+			Usage:     "query remarks from rait.conf or peer list",
+			UsageText: "rait remarks [options] [QUERY]",
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{
+					Name:    "peer",
+					Usage:   "query remarks of the peer with the given name or public key instead",
+					Aliases: []string{"p"},
+				},
+				jsonFlag,
+			}, commonFlags...),
+			Before: commonBeforeFunc,
 			Action: func(ctx *cli.Context) error {
-				if ctx.Args().Len() != 1 {
-					return fmt.Errorf("expecting 1 argument: QUERY")
+				if ctx.Args().Len() > 1 {
+					return fmt.Errorf("expecting at most 1 argument: QUERY")
 				}
-				bc, _ := r.Remarks.Content(&hcl.BodySchema{Blocks: []hcl.BlockHeaderSchema{{Type: "remarks"}}})
-				if len(bc.Blocks.OfType("remarks")) == 0 {
-					return nil
+				var remarks cty.Value
+				var err error
+				if target := ctx.String("peer"); target != "" {
+					// filtered and revoked peers are looked up as well
+					var peers []rait.PeerState
+					peers, err = r.LoadPeerStates(nil)
+					if err != nil {
+						return err
+					}
+					var found *rait.Peer
+					for i, peer := range peers {
+						if peer.Name == target || peer.PublicKey == target {
+							found = &peers[i].Peer
+							break
+						}
+					}
+					if found == nil {
+						return fmt.Errorf("peer %s not found", target)
+					}
+					remarks, err = found.RemarksValue()
+				} else {
+					remarks, err = r.RemarksValue()
 				}
-				attrs, _ := bc.Blocks.OfType("remarks")[0].Body.JustAttributes()
-				attr, _ := attrs[ctx.Args().First()]
-				if attr == nil {
-					return nil
+				if err != nil {
+					return err
 				}
-				value, _ := attr.Expr.Value(nil)
-				fmt.Println(value.AsString())
-				return nil
+				value, ok, err := rait.QueryValue(remarks, ctx.Args().First())
+				if err != nil || !ok {
+					return err
+				}
+				output, err := rait.FormatValue(value, ctx.Bool("json"))
+				if err != nil {
+					return err
+				}
+				_, err = fmt.Println(output)
+				return err
 			},
 		}, {
 			Name:      "babeld",
@@ -160,6 +653,16 @@ func main() {
 					_, err = fmt.Println(strings.Join(links, " "))
 					return err
 				},
+			}, {
+				Name:      "router-id",
+				Usage:     "print the router id of the node, derived from its node_id, for babeld.conf",
+				UsageText: "rait babeld router-id [options]",
+				Flags:     commonFlags,
+				Before:    commonBeforeFunc,
+				Action: func(context *cli.Context) error {
+					_, err := fmt.Println(r.RouterID())
+					return err
+				},
 			}, {
 				Name:      "sync",
 				Aliases:   []string{"s"},
@@ -14,7 +14,9 @@ require (
 	github.com/urfave/cli/v2 v2.2.0
 	github.com/vishvananda/netlink v1.1.1-0.20200606011528-cf6600189038 // indirect
 	github.com/vishvananda/netns v0.0.0-20200728191858-db3c7e526aae
+	github.com/zclconf/go-cty v1.2.0
 	go.uber.org/zap v1.16.0
+	golang.org/x/crypto v0.0.0-20200204104054-c9f3fb736b72
 	golang.org/x/sys v0.0.0-20200930185726-fdedc70b468f
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-00010101000000-000000000000
 )
@@ -4,14 +4,12 @@ import (
 	"fmt"
 	"net"
 	"runtime"
-	"strings"
 	"sync"
 
 	"github.com/Catofes/RAIT/v4/pkg/misc"
 	"github.com/Catofes/netlink"
 	"github.com/vishvananda/netns"
 	"go.uber.org/zap"
-	"golang.org/x/sys/unix"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -75,9 +73,9 @@ func (i *NetnsIsolation) create(attrs misc.Link, h *netlink.Handle, ns netns.NsH
 		src := net.ParseIP(attrs.Address)
 		parent := 0
 		if src.To4() == nil && src[0] == 0xfe && src[1] == 0x80 {
-			link, err := h.LinkByName(strings.TrimRight(attrs.Name, "vxlan") + "wg")
+			link, err := h.LinkByName(attrs.Parent)
 			if err != nil {
-				zap.S().Debugf("find parent for %s failed, err", attrs.Name, err)
+				return fmt.Errorf("failed to find parent %s for %s: %s", attrs.Parent, attrs.Name, err)
 			}
 			parent = link.Attrs().Index
 		}
@@ -121,7 +119,7 @@ func (i *NetnsIsolation) updateVXLANNeigh(attrs misc.Link, h *netlink.Handle, ns
 	for _, neigh := range attrs.FDB {
 		neigh.LinkIndex = link.Attrs().Index
 		if neigh.IP.To4() == nil && neigh.IP[0] == 0xfe && neigh.IP[1] == 0x80 {
-			viaIf, err := h.LinkByName(strings.TrimRight(attrs.Name, "vxlan") + "wg")
+			viaIf, err := h.LinkByName(attrs.Parent)
 			if err != nil {
 				zap.S().Debugf("find fdb viaIf for %s failed, err", neigh.HardwareAddr, err)
 				continue
@@ -141,22 +139,26 @@ func (i *NetnsIsolation) updateWireguardIP(attrs misc.Link, h *netlink.Handle, n
 	var err error
 	link, _ := h.LinkByName(attrs.Name)
 	var addrs []netlink.Addr
-	addrs, err = h.AddrList(link, unix.AF_INET|unix.AF_INET6)
+	addrs, err = h.AddrList(link, netlink.FAMILY_ALL)
 	if err != nil {
 		_ = h.LinkDel(link)
 		return fmt.Errorf("failed to list addr on link %s: %s", attrs.Name, err)
 	}
 	flag := false
-	innerAddress, _, _ := net.ParseCIDR(attrs.Address)
+	k, _ := netlink.ParseAddr(attrs.Address)
 	for _, addr := range addrs {
-		if addr.IP.Equal(innerAddress) {
+		if addr.IPNet.String() == k.IPNet.String() {
 			flag = true
-			break
+			continue
+		}
+		// the inner address or its family has changed, the old address must not linger
+		if err = h.AddrDel(link, &addr); err != nil {
+			_ = h.LinkDel(link)
+			return fmt.Errorf("failed to remove addr %s from link %s: %s", addr.IPNet, attrs.Name, err)
 		}
+		zap.S().Debugf("link %s stale address %s removed", attrs.Name, addr.IPNet)
 	}
 	if !flag {
-		zap.S().Debugf(attrs.Address)
-		k, _ := netlink.ParseAddr(attrs.Address)
 		if err = h.AddrAdd(link, k); err != nil {
 			_ = h.LinkDel(link)
 			return fmt.Errorf("failed to add addr to link %s: %s", attrs.Name, err)
@@ -304,6 +306,9 @@ func (i *NetnsIsolation) wireguardConfDiff(new wgtypes.Config, old *wgtypes.Devi
 			if peer.PresharedKey != nil && peer.PresharedKey.String() != oldPeer.PresharedKey.String() {
 				flag = true
 			}
+			if peer.PersistentKeepaliveInterval != nil && *peer.PersistentKeepaliveInterval != oldPeer.PersistentKeepaliveInterval {
+				flag = true
+			}
 			if flag {
 				zap.S().Debugf("wireguard update peer: %s", peer.PublicKey.String())
 				newPeers = append(newPeers, peer)
@@ -348,6 +353,21 @@ func (i *NetnsIsolation) LinkEnsure(attrs misc.Link) (err error) {
 
 	link, err := targetHandle.LinkByName(attrs.Name)
 	if err == nil {
+		// wireguard-go interfaces are created by the user, thus never in our group at first
+		if int(link.Attrs().Group) != i.group && attrs.WgGoInterface == "" {
+			return fmt.Errorf("link %s already exists but is not managed by rait (ifgroup %d), refusing to touch it", attrs.Name, link.Attrs().Group)
+		}
+		// the source address of a vxlan can not be changed in place, e.g. when the inner address changes family
+		if vxlan, ok := link.(*netlink.Vxlan); ok && attrs.Type == "vxlan" && !vxlan.SrcAddr.Equal(net.ParseIP(attrs.Address)) {
+			zap.S().Debugf("link %s source address changed from %s to %s, recreating", attrs.Name, vxlan.SrcAddr, attrs.Address)
+			if err := i.delete(attrs, targetHandle, targetNetns, transitHandle); err != nil {
+				return err
+			}
+			if err := i.create(attrs, targetHandle, targetNetns, transitHandle); err != nil {
+				return err
+			}
+			return i.update(attrs, targetHandle, targetNetns, transitHandle)
+		}
 		if link.Type() == "wireguard" || link.Type() == "vxlan" ||
 			((link.Type() == "tuntap" || link.Type() == "tun") && attrs.WgGoInterface != "") {
 			zap.S().Debugf("link %s already exists, skipping creation", attrs.Name)
@@ -72,14 +72,23 @@ func NewLLAddrFromKey(key string) *netlink.Addr {
 }
 
 func NewAF(af string) string {
+	parsed, err := ParseAF(af)
+	if err != nil {
+		zap.S().Warnf("%s, falling back to ip4", err)
+		return "ip4"
+	}
+	return parsed
+}
+
+// ParseAF is the strict version of NewAF, it rejects unrecognized address families
+func ParseAF(af string) (string, error) {
 	switch af {
 	case "ip4", "ip6":
-		return af
+		return af, nil
 	case "":
-		return "ip4"
+		return "ip4", nil
 	default:
-		zap.S().Warnf("unrecognized address family %s, falling back to ip4", af)
-		return "ip4"
+		return "", fmt.Errorf("unrecognized address family %s", af)
 	}
 }
 
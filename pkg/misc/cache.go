@@ -0,0 +1,210 @@
+package misc
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Cache is where the peer lists fetched over http are kept, for use when their urls are unreachable
+type Cache struct {
+	Path     string        // cache file, caching is disabled if empty
+	MaxStale time.Duration // age after which the cache is refused, unlimited if zero
+}
+
+// For returns the cache of source, one of n peer sources sharing the cache in rait.conf
+// a single source keeps the path as is, while each of several sources gets the path suffixed with the hash of its location,
+// so the cache survives reordering the sources
+func (c Cache) For(source string, n int) Cache {
+	if n <= 1 || c.Path == "" {
+		return c
+	}
+	sum := sha256.Sum256([]byte(source))
+	c.Path = fmt.Sprintf("%s.%x", c.Path, sum[:4])
+	return c
+}
+
+type peerCache struct {
+	URL          string    // the source the data is fetched from
+	Etag         string    // validator of the data, sent as If-None-Match
+	LastModified string    // validator of the data, sent as If-Modified-Since
+	FetchedAt    time.Time // last time the data is confirmed by the source, zero for caches of previous versions
+	Data         []byte
+	Signature    []byte // detached signature of Data, kept to verify the cache again on every load
+}
+
+func loadPeerCache(path string) *peerCache {
+	p := &peerCache{}
+	if path == "" {
+		return p
+	}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, p); err == nil {
+			return p
+		}
+		zap.S().Warnf("ignoring corrupted peer cache %s: %s", path, err)
+	}
+	return &peerCache{}
+}
+
+// valid tells whether the cache holds data fetched from url
+func (s *peerCache) valid(url string) bool {
+	return s.Data != nil && (s.URL == "" || s.URL == url)
+}
+
+// save writes the cache to path, see WriteFileAtomic, failures are only logged
+func (s *peerCache) save(path string) {
+	if path == "" {
+		return
+	}
+	data, err := json.Marshal(s)
+	if err == nil {
+		err = WriteFileAtomic(path, data, 0644)
+	}
+	if err != nil {
+		zap.S().Warnf("failed to save peer cache %s: %s", path, err)
+	}
+}
+
+// fallback returns the cached data to use when the source is unreachable, nil if there is none usable
+func (s *peerCache) fallback(url string, cache Cache) []byte {
+	if !s.valid(url) {
+		zap.S().Warnf("no cache of %s to fall back to", url)
+		return nil
+	}
+	if cache.MaxStale != 0 {
+		if s.FetchedAt.IsZero() {
+			zap.S().Errorf("refusing cache %s of unknown age, exceeding max stale %s", cache.Path, cache.MaxStale)
+			return nil
+		}
+		if age := time.Since(s.FetchedAt); age > cache.MaxStale {
+			zap.S().Errorf("refusing cache %s fetched %s ago, exceeding max stale %s", cache.Path, age.Round(time.Second), cache.MaxStale)
+			return nil
+		}
+	}
+	zap.S().Warnf("falling back to cache %s of %s, fetched at %s", cache.Path, url, s.FetchedAt.Format(time.RFC3339))
+	return s.Data
+}
+
+// loadURLwithCache fetches url, revalidating the cache with its etag and last modified time
+// if verifier is not nil, both the cache and the fetched data must carry a valid signature,
+// fetched data failing verification is refused in favour of the cache
+func loadURLwithCache(url string, cache Cache, verifier *Verifier) []byte {
+	c := loadPeerCache(cache.Path)
+	if c.valid(url) && verifier != nil {
+		if err := verifier.Verify(c.Data, c.Signature); err != nil {
+			zap.S().Warnf("discarding cache %s: %s", cache.Path, err)
+			c = &peerCache{}
+		}
+	}
+
+	req, _ := http.NewRequest("GET", url, nil)
+	if c.valid(url) {
+		zap.S().Debugf("revalidating cache %s of %s", cache.Path, url)
+		if c.Etag != "" {
+			req.Header.Set("If-None-Match", c.Etag)
+		}
+		if c.LastModified != "" {
+			req.Header.Set("If-Modified-Since", c.LastModified)
+		}
+	} else {
+		zap.S().Debugf("cache miss, loading from %s", url)
+	}
+	resp, err := DefaultFetcher.Do(req)
+	if err != nil {
+		zap.S().Warnf("failed to load %s: %s", url, err)
+		return c.fallback(url, cache)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && c.valid(url):
+		zap.S().Infof("loaded %s: %s, using cache %s", url, resp.Status, cache.Path)
+		c.FetchedAt = time.Now()
+		c.save(cache.Path)
+		return c.Data
+	case resp.StatusCode == http.StatusOK:
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			zap.S().Warnf("failed to load %s: %s", url, err)
+			return c.fallback(url, cache)
+		}
+		var signature []byte
+		if verifier != nil {
+			if signature, err = verifier.fetch(url); err == nil {
+				err = verifier.Verify(data, signature)
+			}
+			if err != nil {
+				zap.S().Errorf("refusing unverified data from %s: %s", url, err)
+				return c.fallback(url, cache)
+			}
+		}
+		c = &peerCache{
+			URL:          url,
+			Etag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			FetchedAt:    time.Now(),
+			Data:         data,
+			Signature:    signature,
+		}
+		c.save(cache.Path)
+		zap.S().Infof("loaded %s: %s", url, resp.Status)
+		return c.Data
+	default:
+		zap.S().Warnf("failed to load %s: %s", url, resp.Status)
+		return c.fallback(url, cache)
+	}
+}
+
+// LoadWithCache loads the peer list of source with fetch, which can not be revalidated nor signed, e.g. discovered from dns
+// the result is kept in cache, which is used when fetch fails, see loadURLwithCache
+func LoadWithCache(source string, cache Cache, fetch func() ([]byte, error)) []byte {
+	c := loadPeerCache(cache.Path)
+	data, err := fetch()
+	if err != nil {
+		zap.S().Warnf("failed to load %s: %s", source, err)
+		return c.fallback(source, cache)
+	}
+	c = &peerCache{URL: source, FetchedAt: time.Now(), Data: data}
+	c.save(cache.Path)
+	zap.S().Infof("loaded %s", source)
+	return c.Data
+}
+
+// CacheInfo is the metadata of a peer cache
+type CacheInfo struct {
+	Path         string    `json:"path"`
+	URL          string    `json:"url"`
+	Etag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	FetchedAt    time.Time `json:"fetched_at"`
+	Size         int       `json:"size"`
+	Signed       bool      `json:"signed"`
+}
+
+// InspectCache reads the metadata of the peer cache at path
+func InspectCache(path string) (*CacheInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer cache: %s", err)
+	}
+	c := &peerCache{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("failed to decode peer cache %s: %s", path, err)
+	}
+	return &CacheInfo{
+		Path:         path,
+		URL:          c.URL,
+		Etag:         c.Etag,
+		LastModified: c.LastModified,
+		FetchedAt:    c.FetchedAt,
+		Size:         len(c.Data),
+		Signed:       len(c.Signature) != 0,
+	}, nil
+}
@@ -0,0 +1,23 @@
+package misc
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/hcl/v2"
+)
+
+// FormatDiagnostic renders a single diagnostic as file:line:col: severity: summary: detail
+func FormatDiagnostic(diag *hcl.Diagnostic) string {
+	severity := "error"
+	if diag.Severity == hcl.DiagWarning {
+		severity = "warning"
+	}
+	message := diag.Summary
+	if diag.Detail != "" {
+		message = fmt.Sprintf("%s: %s", message, diag.Detail)
+	}
+	if diag.Subject == nil {
+		return fmt.Sprintf("%s: %s", severity, message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", diag.Subject.Filename, diag.Subject.Start.Line, diag.Subject.Start.Column, severity, message)
+}
@@ -0,0 +1,41 @@
+package misc
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// DefaultResolver performs the dns lookups of peer discovery
+// it is replaced with the one configured in the resolver block of rait.conf once loaded
+var DefaultResolver = &Resolver{Resolver: net.DefaultResolver, Timeout: 10 * time.Second}
+
+// Resolver is a dns resolver with a deadline for each discovery
+type Resolver struct {
+	*net.Resolver
+	Timeout time.Duration
+}
+
+// NewResolver returns a resolver querying the dns server at address, in the form of host:port,
+// or those of the system if address is empty, timeout falls back to that of DefaultResolver if zero
+func NewResolver(address string, timeout time.Duration) *Resolver {
+	r := &Resolver{Resolver: net.DefaultResolver, Timeout: timeout}
+	if r.Timeout == 0 {
+		r.Timeout = 10 * time.Second
+	}
+	if address != "" {
+		r.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, address)
+			},
+		}
+	}
+	return r
+}
+
+// Context returns the context bounding a discovery by the timeout
+func (r *Resolver) Context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), r.Timeout)
+}
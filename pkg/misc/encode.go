@@ -0,0 +1,98 @@
+package misc
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty/gocty"
+)
+
+// EncodeHCL encodes the given struct into a new hcl file, following the same tags as gohcl
+// unlike gohcl.EncodeIntoBody, optional attributes holding zero values are omitted
+func EncodeHCL(v interface{}) *hclwrite.File {
+	f := hclwrite.NewEmptyFile()
+	encodeIntoBody(reflect.Indirect(reflect.ValueOf(v)), f.Body())
+	return f
+}
+
+func encodeIntoBody(rv reflect.Value, dst *hclwrite.Body) {
+	ty := rv.Type()
+	empty, prevWasBlock := true, false
+	for i := 0; i < ty.NumField(); i++ {
+		tag, ok := ty.Field(i).Tag.Lookup("hcl")
+		if !ok {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		name, kind := parts[0], "attr"
+		if len(parts) > 1 {
+			kind = parts[1]
+		}
+		field := rv.Field(i)
+
+		switch kind {
+		case "attr", "optional":
+			if field.Kind() == reflect.Ptr && field.IsNil() {
+				continue
+			}
+			if kind == "optional" && field.IsZero() {
+				continue
+			}
+			value := reflect.Indirect(field).Interface()
+			valTy, err := gocty.ImpliedType(value)
+			if err != nil {
+				continue // not a plain value, e.g. hcl.Expression
+			}
+			val, err := gocty.ToCtyValue(value, valTy)
+			if err != nil {
+				continue
+			}
+			if prevWasBlock {
+				dst.AppendNewline()
+				prevWasBlock = false
+			}
+			dst.SetAttributeValue(name, val)
+			empty = false
+		case "block":
+			var elems []reflect.Value
+			switch field.Kind() {
+			case reflect.Slice:
+				for j := 0; j < field.Len(); j++ {
+					elems = append(elems, field.Index(j))
+				}
+			default:
+				elems = append(elems, field)
+			}
+			for _, elem := range elems {
+				if elem.Kind() == reflect.Ptr {
+					if elem.IsNil() {
+						continue
+					}
+					elem = elem.Elem()
+				}
+				if elem.Kind() != reflect.Struct {
+					continue // not a decoded block, e.g. hcl.Body
+				}
+				if !empty && !prevWasBlock {
+					dst.AppendNewline()
+				}
+				empty, prevWasBlock = false, true
+				block := dst.AppendNewBlock(name, blockLabels(elem))
+				encodeIntoBody(elem, block.Body())
+			}
+		}
+	}
+}
+
+// blockLabels collects the values of the fields tagged as labels
+func blockLabels(rv reflect.Value) []string {
+	var labels []string
+	ty := rv.Type()
+	for i := 0; i < ty.NumField(); i++ {
+		if tag := ty.Field(i).Tag.Get("hcl"); strings.HasSuffix(tag, ",label") {
+			labels = append(labels, rv.Field(i).String())
+		}
+	}
+	return labels
+}
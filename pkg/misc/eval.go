@@ -0,0 +1,302 @@
+package misc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+	"github.com/zclconf/go-cty/cty/function/stdlib"
+	"github.com/zclconf/go-cty/cty/gocty"
+)
+
+// Variables overrides the defaults in variables blocks, it is exposed as var.* in hcl expressions
+var Variables = map[string]string{}
+
+// variablesEnvPrefix marks environment variables which also override the defaults in variables blocks
+const variablesEnvPrefix = "RAIT_VAR_"
+
+// evalSchema picks the blocks defining variables and locals out of a top level body
+var evalSchema = &hcl.BodySchema{Blocks: []hcl.BlockHeaderSchema{{Type: "variables"}, {Type: "locals"}}}
+
+// NewFunctions returns the standard function library available in hcl expressions of the local configuration
+// relative paths passed to file() are resolved against basedir
+func NewFunctions(basedir string) map[string]function.Function {
+	functions := PureFunctions()
+	functions["env"] = envFunc
+	functions["file"] = newFileFunc(basedir)
+	functions["hostname"] = hostnameFunc
+	return functions
+}
+
+// PureFunctions returns the functions which depend on their arguments only,
+// the only ones available to untrusted documents such as fetched peer lists, see DecodeUntrustedBody
+func PureFunctions() map[string]function.Function {
+	return map[string]function.Function{
+		"cidrsubnet": cidrSubnetFunc,
+		"format":     stdlib.FormatFunc,
+		"formatlist": stdlib.FormatListFunc,
+		"lower":      stdlib.LowerFunc,
+		"upper":      stdlib.UpperFunc,
+		"coalesce":   stdlib.CoalesceFunc,
+		"concat":     stdlib.ConcatFunc,
+		"length":     stdlib.LengthFunc,
+		"min":        stdlib.MinFunc,
+		"max":        stdlib.MaxFunc,
+	}
+}
+
+// EvalContextReceiver is implemented by the values which keep the evaluation context they are decoded with,
+// for evaluating the expressions left undecoded, e.g. in remain bodies, later on
+type EvalContextReceiver interface {
+	SetEvalContext(ctx *hcl.EvalContext)
+}
+
+// DecodeBody evaluates the variables and locals blocks of body into an evaluation context,
+// then decodes the rest of body into the given interface with it
+// in expressions, var.NAME refers to the variables, which default to the values in variables blocks
+// and can be overridden by Variables or RAIT_VAR_NAME environment variables, while local.NAME refers to
+// the locals, which are evaluated in dependency order and may refer to variables and other locals
+// if v implements EvalContextReceiver, it receives the evaluation context after decoding
+func DecodeBody(body hcl.Body, basedir string, v interface{}) hcl.Diagnostics {
+	content, remain, diags := body.PartialContent(evalSchema)
+	if diags.HasErrors() {
+		return diags
+	}
+	ctx := &hcl.EvalContext{
+		Variables: map[string]cty.Value{},
+		Functions: NewFunctions(basedir),
+	}
+
+	variables, varDiags := evalVariables(content.Blocks.OfType("variables"), ctx)
+	diags = append(diags, varDiags...)
+	ctx.Variables["var"] = cty.ObjectVal(variables)
+
+	diags = append(diags, evalLocals(content.Blocks.OfType("locals"), ctx)...)
+	if diags.HasErrors() {
+		return diags
+	}
+	diags = append(diags, gohcl.DecodeBody(remain, ctx, v)...)
+	if receiver, ok := v.(EvalContextReceiver); ok {
+		receiver.SetEvalContext(ctx)
+	}
+	return diags
+}
+
+// DecodeUntrustedBody decodes body into the given interface with the pure functions only, see PureFunctions,
+// without variables, locals or anything else revealing the local files or the environment,
+// so that a peer list from a compromised source can not leak them, e.g. through the names it makes rait resolve
+// if v implements EvalContextReceiver, it receives the evaluation context after decoding
+func DecodeUntrustedBody(body hcl.Body, v interface{}) hcl.Diagnostics {
+	ctx := &hcl.EvalContext{Functions: PureFunctions()}
+	diags := gohcl.DecodeBody(body, ctx, v)
+	if receiver, ok := v.(EvalContextReceiver); ok {
+		receiver.SetEvalContext(ctx)
+	}
+	return diags
+}
+
+func evalVariables(blocks hcl.Blocks, ctx *hcl.EvalContext) (map[string]cty.Value, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	variables := map[string]cty.Value{}
+	for _, block := range blocks {
+		attrs, attrDiags := block.Body.JustAttributes()
+		diags = append(diags, attrDiags...)
+		for name, attr := range attrs {
+			if _, ok := variables[name]; ok {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Duplicate variable",
+					Detail:   fmt.Sprintf("variable %s is defined more than once", name),
+					Subject:  attr.NameRange.Ptr(),
+				})
+				continue
+			}
+			value, valueDiags := attr.Expr.Value(ctx)
+			diags = append(diags, valueDiags...)
+			variables[name] = value
+		}
+	}
+	for _, env := range os.Environ() {
+		if kv := strings.SplitN(env, "=", 2); strings.HasPrefix(kv[0], variablesEnvPrefix) {
+			variables[strings.TrimPrefix(kv[0], variablesEnvPrefix)] = cty.StringVal(kv[1])
+		}
+	}
+	for name, value := range Variables {
+		variables[name] = cty.StringVal(value)
+	}
+	return variables, diags
+}
+
+func evalLocals(blocks hcl.Blocks, ctx *hcl.EvalContext) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	pending := map[string]*hcl.Attribute{}
+	for _, block := range blocks {
+		attrs, attrDiags := block.Body.JustAttributes()
+		diags = append(diags, attrDiags...)
+		for name, attr := range attrs {
+			if _, ok := pending[name]; ok {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Duplicate local",
+					Detail:   fmt.Sprintf("local %s is defined more than once", name),
+					Subject:  attr.NameRange.Ptr(),
+				})
+				continue
+			}
+			pending[name] = attr
+		}
+	}
+
+	locals := map[string]cty.Value{}
+	ctx.Variables["local"] = cty.EmptyObjectVal
+	for len(pending) != 0 {
+		names := make([]string, 0, len(pending))
+		for name := range pending {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		progress := false
+		for _, name := range names {
+			attr := pending[name]
+			if !localsReady(attr.Expr, locals) {
+				continue
+			}
+			value, valueDiags := attr.Expr.Value(ctx)
+			diags = append(diags, valueDiags...)
+			locals[name] = value
+			ctx.Variables["local"] = cty.ObjectVal(locals)
+			delete(pending, name)
+			progress = true
+		}
+		if progress {
+			continue
+		}
+		for _, name := range names {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Unresolvable local",
+				Detail:   fmt.Sprintf("local %s refers to undefined locals, or is part of a reference cycle", name),
+				Subject:  pending[name].Expr.Range().Ptr(),
+			})
+		}
+		break
+	}
+	return diags
+}
+
+// localsReady tells whether all the locals referred to by expr have been evaluated
+func localsReady(expr hcl.Expression, locals map[string]cty.Value) bool {
+	for _, traversal := range expr.Variables() {
+		if traversal.RootName() != "local" || len(traversal) < 2 {
+			continue
+		}
+		if attr, ok := traversal[1].(hcl.TraverseAttr); ok {
+			if _, ok := locals[attr.Name]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+var envFunc = function.New(&function.Spec{
+	Params:   []function.Parameter{{Name: "name", Type: cty.String}},
+	VarParam: &function.Parameter{Name: "default", Type: cty.String},
+	Type:     function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		if value, ok := os.LookupEnv(args[0].AsString()); ok {
+			return cty.StringVal(value), nil
+		}
+		if len(args) > 1 {
+			return args[1], nil
+		}
+		return cty.NilVal, fmt.Errorf("environment variable %s is not set", args[0].AsString())
+	},
+})
+
+func newFileFunc(basedir string) function.Function {
+	return function.New(&function.Spec{
+		Params: []function.Parameter{{Name: "path", Type: cty.String}},
+		Type:   function.StaticReturnType(cty.String),
+		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+			path := args[0].AsString()
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(basedir, path)
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return cty.NilVal, err
+			}
+			return cty.StringVal(string(data)), nil
+		},
+	})
+}
+
+var hostnameFunc = function.New(&function.Spec{
+	Type: function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return cty.NilVal, err
+		}
+		return cty.StringVal(hostname), nil
+	},
+})
+
+var cidrSubnetFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "prefix", Type: cty.String},
+		{Name: "newbits", Type: cty.Number},
+		{Name: "netnum", Type: cty.Number},
+	},
+	Type: function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		var newbits, netnum int
+		if err := gocty.FromCtyValue(args[1], &newbits); err != nil {
+			return cty.NilVal, err
+		}
+		if err := gocty.FromCtyValue(args[2], &netnum); err != nil {
+			return cty.NilVal, err
+		}
+		subnet, err := CIDRSubnet(args[0].AsString(), newbits, netnum)
+		if err != nil {
+			return cty.NilVal, err
+		}
+		return cty.StringVal(subnet), nil
+	},
+})
+
+// CIDRSubnet calculates the netnum-th subnet of prefix, extending the prefix length by newbits
+func CIDRSubnet(prefix string, newbits, netnum int) (string, error) {
+	_, network, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return "", fmt.Errorf("invalid prefix %s: %s", prefix, err)
+	}
+	ones, bits := network.Mask.Size()
+	if newbits < 0 || ones+newbits > bits {
+		return "", fmt.Errorf("can not extend prefix %s by %d bits", prefix, newbits)
+	}
+	if netnum < 0 || big.NewInt(int64(netnum)).BitLen() > newbits {
+		return "", fmt.Errorf("netnum %d does not fit in %d bits", netnum, newbits)
+	}
+	ip := network.IP
+	if bits == 32 {
+		ip = ip.To4()
+	}
+	addr := new(big.Int).SetBytes(ip)
+	addr.Or(addr, new(big.Int).Lsh(big.NewInt(int64(netnum)), uint(bits-ones-newbits)))
+	result := make([]byte, len(ip))
+	raw := addr.Bytes()
+	copy(result[len(result)-len(raw):], raw)
+	return (&net.IPNet{IP: result, Mask: net.CIDRMask(ones+newbits, bits)}).String(), nil
+}
@@ -0,0 +1,238 @@
+package misc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultFetcher performs every http request of rait, e.g. for peer lists, see NewReadCloser and LoadPeers
+// it is replaced with the one configured in the fetch block of rait.conf once loaded
+var DefaultFetcher = &Fetcher{Client: &http.Client{Timeout: 30 * time.Second}}
+
+// Fetcher is a http client retrying failed requests, with additional headers sent in the requests within their scopes
+type Fetcher struct {
+	Client  *http.Client
+	Retries int           // additional attempts after a network error or a server error
+	Backoff time.Duration // delay before the first retry, doubled after each retry
+	Scopes  []FetchScope  // the headers of the longest matching scope are added to a request
+}
+
+// FetchScope is a set of headers, typically credentials, only sent to the urls under Prefix
+type FetchScope struct {
+	Prefix *url.URL // the scheme and the host must be equal, and the path must start with the one of Prefix
+	Header http.Header
+}
+
+// Match tells whether u is within the scope
+func (s *FetchScope) Match(u *url.URL) bool {
+	return u.Scheme == s.Prefix.Scheme && strings.EqualFold(u.Host, s.Prefix.Host) && strings.HasPrefix(u.Path, s.Prefix.Path)
+}
+
+// FetchOptions are the settings to build a Fetcher from, durations are in the format of time.ParseDuration
+type FetchOptions struct {
+	Timeout        string
+	ConnectTimeout string
+	Retries        int
+	Backoff        string
+	CABundle       string // file of pem encoded certificates trusted instead of the system ones
+	ClientCert     string // file of the pem encoded client certificate for mutual tls
+	ClientKey      string // file of the pem encoded private key of ClientCert
+	Auth           []FetchAuth
+	Proxy          string // proxy url, the environment variables are honoured if empty
+}
+
+// FetchAuth is the credentials and the headers sent to the urls starting with URLPrefix, see FetchScope
+type FetchAuth struct {
+	URLPrefix   string // url with a scheme and a host, e.g. https://registry.example/private/
+	BearerToken string
+	Username    string
+	Password    string
+	Header      map[string]string
+}
+
+// NewFetcher builds a Fetcher from the given options, zero values fall back to those of DefaultFetcher
+func NewFetcher(o FetchOptions) (*Fetcher, error) {
+	var err error
+	timeout, connectTimeout, backoff := 30*time.Second, 30*time.Second, time.Second
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{{"timeout", o.Timeout, &timeout}, {"connect_timeout", o.ConnectTimeout, &connectTimeout}, {"backoff", o.Backoff, &backoff}} {
+		if d.value == "" {
+			continue
+		}
+		if *d.dst, err = time.ParseDuration(d.value); err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", d.name, err)
+		}
+	}
+	if o.Retries < 0 {
+		return nil, fmt.Errorf("invalid retries: must not be negative, got %d", o.Retries)
+	}
+
+	tlsConfig := &tls.Config{}
+	if o.CABundle != "" {
+		data, err := ioutil.ReadFile(o.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca bundle: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("failed to read ca bundle: no certificate found in %s", o.CABundle)
+		}
+	}
+	if o.ClientCert != "" || o.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(o.ClientCert, o.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if o.Proxy != "" {
+		proxyURL, err := url.Parse(o.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %s", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	scopes := make([]FetchScope, 0, len(o.Auth))
+	for _, auth := range o.Auth {
+		scope, err := auth.scope()
+		if err != nil {
+			return nil, fmt.Errorf("auth %s: %s", auth.URLPrefix, err)
+		}
+		scopes = append(scopes, scope)
+	}
+
+	f := &Fetcher{
+		Client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:               proxy,
+				DialContext:         (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+				TLSClientConfig:     tlsConfig,
+				TLSHandshakeTimeout: connectTimeout,
+				ForceAttemptHTTP2:   true,
+			},
+		},
+		Retries: o.Retries,
+		Backoff: backoff,
+		Scopes:  scopes,
+	}
+	f.Client.CheckRedirect = f.checkRedirect
+	return f, nil
+}
+
+func (a FetchAuth) scope() (FetchScope, error) {
+	prefix, err := url.Parse(a.URLPrefix)
+	if err != nil {
+		return FetchScope{}, fmt.Errorf("invalid url_prefix: %s", err)
+	}
+	if (prefix.Scheme != "http" && prefix.Scheme != "https") || prefix.Host == "" {
+		return FetchScope{}, fmt.Errorf("invalid url_prefix: expecting a http or https url with a host")
+	}
+	header := http.Header{}
+	for k, v := range a.Header {
+		header.Set(k, v)
+	}
+	switch {
+	case a.BearerToken != "" && a.Username != "":
+		return FetchScope{}, fmt.Errorf("bearer token and basic auth are mutually exclusive")
+	case a.BearerToken != "":
+		header.Set("Authorization", "Bearer "+a.BearerToken)
+	case a.Username != "":
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(a.Username, a.Password)
+		header.Set("Authorization", req.Header.Get("Authorization"))
+	}
+	return FetchScope{Prefix: prefix, Header: header}, nil
+}
+
+// scope returns the longest scope matching u, nil if none
+func (f *Fetcher) scope(u *url.URL) *FetchScope {
+	var found *FetchScope
+	for i := range f.Scopes {
+		if s := &f.Scopes[i]; s.Match(u) && (found == nil || len(s.Prefix.Path) > len(found.Prefix.Path)) {
+			found = s
+		}
+	}
+	return found
+}
+
+// checkRedirect switches the headers to the scope the request is redirected to, if it differs from the one of the original request,
+// net/http copies the headers of the original request, only dropping the well known sensitive ones when the host changes
+func (f *Fetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+	from, to := f.scope(via[0].URL), f.scope(req.URL)
+	if from == to {
+		return nil
+	}
+	if from != nil {
+		for k := range from.Header {
+			req.Header.Del(k)
+		}
+	}
+	if to != nil {
+		for k, v := range to.Header {
+			req.Header[k] = v
+		}
+	}
+	return nil
+}
+
+// Do sends the request, retrying on network errors and server errors
+// a request with a body is only retried if the body can be replayed, i.e. GetBody is set as by http.NewRequest for in memory bodies
+// the response of the last attempt is returned as is
+func (f *Fetcher) Do(req *http.Request) (*http.Response, error) {
+	if scope := f.scope(req.URL); scope != nil {
+		for k, v := range scope.Header {
+			if req.Header.Get(k) == "" {
+				req.Header[k] = v
+			}
+		}
+	}
+	backoff := f.Backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := f.Client.Do(req)
+		retryable := err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		replayable := req.Body == nil || req.GetBody != nil
+		if !retryable || !replayable || attempt >= f.Retries {
+			return resp, err
+		}
+		if err == nil {
+			err = fmt.Errorf("%s", resp.Status)
+			resp.Body.Close()
+		}
+		zap.S().Warnf("request to %s failed: %s, retry in %s", req.URL, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Get fetches url, see Do
+func (f *Fetcher) Get(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return f.Do(req)
+}
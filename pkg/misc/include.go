@@ -0,0 +1,135 @@
+package misc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+)
+
+// includeSchema picks the include attribute out of a top level file
+var includeSchema = &hcl.BodySchema{Attributes: []hcl.AttributeSchema{{Name: "include"}}}
+
+// LoadHCL reads and parses the hcl configuration at path, which may consist of several fragments
+// if path is a directory, every *.conf file inside is a top level fragment, in lexical order
+// a top level fragment may specify include = ["glob", ...], relative globs are resolved against its directory,
+// the matched files are appended right after it, in the order of the globs then in lexical order
+// a file is loaded once only, even if it is both a top level fragment and included, or included more than once
+// the fragments are merged as in hcl.MergeFiles: blocks accumulate in order, while an attribute,
+// or a block decoded as a singleton, must not be defined by more than one fragment
+func LoadHCL(path string) (hcl.Body, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	paths := []string{path}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		paths, _ = filepath.Glob(filepath.Join(path, "*.conf"))
+		if len(paths) == 0 {
+			return nil, append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "No configuration found",
+				Detail:   fmt.Sprintf("directory %s contains no *.conf file", path),
+			})
+		}
+	}
+
+	var bodies []hcl.Body
+	loaded := make(map[string]bool)
+	for _, p := range paths {
+		if !firstLoad(loaded, p) {
+			continue
+		}
+		body, includes, fragmentDiags := loadFragment(p)
+		diags = append(diags, fragmentDiags...)
+		if body == nil {
+			continue
+		}
+		bodies = append(bodies, body)
+		for _, include := range includes {
+			if !firstLoad(loaded, include) {
+				continue
+			}
+			body, nested, fragmentDiags := loadFragment(include)
+			diags = append(diags, fragmentDiags...)
+			if body == nil {
+				continue
+			}
+			if len(nested) != 0 {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Nested include",
+					Detail:   fmt.Sprintf("include is only honoured in top level files, but found in %s", include),
+					Subject:  body.MissingItemRange().Ptr(),
+				})
+			}
+			bodies = append(bodies, body)
+		}
+	}
+	return hcl.MergeBodies(bodies), diags
+}
+
+// firstLoad records path in loaded, telling whether it is not loaded yet, paths are compared in absolute and clean form
+func firstLoad(loaded map[string]bool, path string) bool {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	path = filepath.Clean(path)
+	if loaded[path] {
+		return false
+	}
+	loaded[path] = true
+	return true
+}
+
+// BaseDir returns the directory that relative paths in the configuration at path are resolved against
+func BaseDir(path string) string {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return path
+	}
+	return filepath.Dir(path)
+}
+
+// loadFragment parses a single file, returning its body without the include attribute, and the files it includes
+func loadFragment(path string) (hcl.Body, []string, hcl.Diagnostics) {
+	data, err := ReadAll(path)
+	if err != nil {
+		return nil, nil, hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to read file",
+			Detail:   err.Error(),
+		}}
+	}
+	file, diags := ParseHCL(path, data)
+	if diags.HasErrors() {
+		return nil, nil, diags
+	}
+	content, body, contentDiags := file.Body.PartialContent(includeSchema)
+	diags = append(diags, contentDiags...)
+	attr, ok := content.Attributes["include"]
+	if !ok {
+		return body, nil, diags
+	}
+
+	var patterns []string
+	if decodeDiags := gohcl.DecodeExpression(attr.Expr, nil, &patterns); decodeDiags.HasErrors() {
+		return body, nil, append(diags, decodeDiags...)
+	}
+	var includes []string
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid include pattern",
+				Detail:   fmt.Sprintf("%s: %s", pattern, err),
+				Subject:  attr.Expr.Range().Ptr(),
+			})
+			continue
+		}
+		includes = append(includes, matches...)
+	}
+	return body, includes, diags
+}
@@ -3,9 +3,11 @@ package misc
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 )
 
 // NewWriteCloser returns a WriteCloser from the given path
@@ -39,10 +41,14 @@ func NewReadCloser(path string) (io.ReadCloser, error) {
 	}
 	switch parsed.Scheme {
 	case "http", "https":
-		resp, err := http.Get(path)
+		resp, err := DefaultFetcher.Get(path)
 		if err != nil {
 			return nil, fmt.Errorf("failed to make http request: %s: %s", path, err)
 		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to make http request: %s: %s", path, resp.Status)
+		}
 		return resp.Body, nil
 	case "":
 		if path == "-" {
@@ -57,3 +63,31 @@ func NewReadCloser(path string) (io.ReadCloser, error) {
 		return nil, fmt.Errorf("unsupported url scheme to read: %s", parsed.Scheme)
 	}
 }
+
+// WriteFileAtomic writes data to a temporary file then renames it over path, so that a crash never leaves a torn file
+// the parent directory is created if missing
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
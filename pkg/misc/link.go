@@ -1,6 +1,9 @@
 package misc
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/Catofes/netlink"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -16,6 +19,25 @@ type Link struct {
 	FDB           []netlink.Neigh
 	Config        wgtypes.Config
 	WgGoInterface string
+	Parent        string // the link to send encapsulated packets through, for vxlan links
+}
+
+// IFNameMaxLen is the maximum length of interface names, IFNAMSIZ minus the terminating null byte
+const IFNameMaxLen = 15
+
+// ValidateIFName checks whether name is acceptable as an interface name by the kernel
+func ValidateIFName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("interface name must not be empty")
+	case len(name) > IFNameMaxLen:
+		return fmt.Errorf("interface name %s is longer than %d bytes", name, IFNameMaxLen)
+	case name == "." || name == "..":
+		return fmt.Errorf("interface name %s is reserved", name)
+	case strings.ContainsAny(name, "/: \t\n"):
+		return fmt.Errorf("interface name %s contains slash, colon or whitespace", name)
+	}
+	return nil
 }
 
 func LinkString(links []Link) (stringed []string) {
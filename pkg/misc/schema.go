@@ -0,0 +1,107 @@
+package misc
+
+import (
+	"reflect"
+	"strings"
+)
+
+// JSONSchema derives a json schema, in the form of nested maps, describing the json syntax of
+// the hcl decoded into the given struct, following the same tags as gohcl
+// repeated blocks may be written as a single object or as an array, as accepted by hcl
+// blocks with labels are written as objects keyed by their labels
+func JSONSchema(v interface{}) map[string]interface{} {
+	schema := structSchema(reflect.Indirect(reflect.ValueOf(v)).Type())
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	return schema
+}
+
+func structSchema(ty reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := make([]string, 0)
+	additional := false
+	for i := 0; i < ty.NumField(); i++ {
+		tag, ok := ty.Field(i).Tag.Lookup("hcl")
+		if !ok {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		name, kind := parts[0], "attr"
+		if len(parts) > 1 {
+			kind = parts[1]
+		}
+		fieldTy := ty.Field(i).Type
+
+		switch kind {
+		case "attr", "optional":
+			properties[name] = valueSchema(fieldTy)
+			if kind == "attr" {
+				required = append(required, name)
+			}
+		case "block":
+			elemTy := fieldTy
+			repeated := false
+			if elemTy.Kind() == reflect.Slice {
+				elemTy, repeated = elemTy.Elem(), true
+			}
+			if elemTy.Kind() == reflect.Ptr {
+				elemTy = elemTy.Elem()
+			} else if !repeated {
+				required = append(required, name)
+			}
+			block := structSchema(elemTy)
+			if repeated {
+				block = map[string]interface{}{
+					"oneOf": []interface{}{block, map[string]interface{}{"type": "array", "items": block}},
+				}
+			}
+			for j := labelCount(elemTy); j > 0; j-- {
+				block = map[string]interface{}{"type": "object", "additionalProperties": block}
+			}
+			properties[name] = block
+		case "remain":
+			additional = true
+		}
+	}
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": additional,
+	}
+	if len(required) != 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func valueSchema(ty reflect.Type) map[string]interface{} {
+	if ty.Kind() == reflect.Ptr {
+		ty = ty.Elem()
+	}
+	switch ty.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": valueSchema(ty.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": valueSchema(ty.Elem())}
+	}
+	// arbitrary values, e.g. hcl.Expression
+	return map[string]interface{}{}
+}
+
+func labelCount(ty reflect.Type) int {
+	n := 0
+	for i := 0; i < ty.NumField(); i++ {
+		if strings.HasSuffix(ty.Field(i).Tag.Get("hcl"), ",label") {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,64 @@
+package misc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Secret describes the possible sources of a secret value, at most one of them should be set
+// the resolved value is never logged, errors only mention where it was looked up
+type Secret struct {
+	Inline     string // the secret itself
+	File       string // path of a file containing the secret
+	Env        string // name of an environment variable containing the secret
+	Credential string // name of a systemd credential, looked up in $CREDENTIALS_DIRECTORY
+}
+
+// Sources returns the number of sources configured
+func (s Secret) Sources() int {
+	n := 0
+	for _, source := range []string{s.Inline, s.File, s.Env, s.Credential} {
+		if source != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// Resolve returns the secret from the configured source, with surrounding whitespaces trimmed
+// it returns an empty string without error if no source is configured
+func (s Secret) Resolve() (string, error) {
+	if s.Sources() > 1 {
+		return "", fmt.Errorf("conflicting secret sources, at most one is allowed")
+	}
+	switch {
+	case s.Inline != "":
+		return strings.TrimSpace(s.Inline), nil
+	case s.File != "":
+		return readSecretFile(s.File)
+	case s.Env != "":
+		value, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", s.Env)
+		}
+		return strings.TrimSpace(value), nil
+	case s.Credential != "":
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return "", fmt.Errorf("failed to load credential %s: CREDENTIALS_DIRECTORY is not set", s.Credential)
+		}
+		return readSecretFile(filepath.Join(dir, s.Credential))
+	}
+	return "", nil
+}
+
+func readSecretFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %s", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,236 @@
+package misc
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// the algorithm tags of signify and minisign keys and signatures,
+// signatureAlgHashed is minisign signing the blake2b-512 hash of the message instead of the message itself
+const (
+	signatureAlg       = "Ed"
+	signatureAlgHashed = "ED"
+	keyIDLen           = 8
+	commentPrefix      = "untrusted comment:"
+	trustedPrefix      = "trusted comment:"
+)
+
+// SigningKey is an ed25519 public key that peer lists are signed with
+type SigningKey struct {
+	ID  []byte // optional, signify or minisign key number, matched against the one in the signature
+	Key ed25519.PublicKey
+}
+
+// ParseSigningKey parses an ed25519 public key, either 32 bytes base64 encoded,
+// or in signify or minisign format, with or without the untrusted comment line
+func ParseSigningKey(s string) (SigningKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(contentLines(s), ""))
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("invalid signing key: %s", err)
+	}
+	switch {
+	case len(raw) == ed25519.PublicKeySize:
+		return SigningKey{Key: raw}, nil
+	case len(raw) == 2+keyIDLen+ed25519.PublicKeySize && string(raw[:2]) == signatureAlg:
+		return SigningKey{ID: raw[2 : 2+keyIDLen], Key: raw[2+keyIDLen:]}, nil
+	default:
+		return SigningKey{}, fmt.Errorf("invalid signing key: neither a raw ed25519 key nor in signify or minisign format")
+	}
+}
+
+// String encodes the key in signify format, which is also understood by minisign
+func (k SigningKey) String() string {
+	id := k.ID
+	if id == nil {
+		id = keyID(k.Key)
+	}
+	raw := append(append([]byte(signatureAlg), id...), k.Key...)
+	return fmt.Sprintf("%s rait public key\n%s\n", commentPrefix, base64.StdEncoding.EncodeToString(raw))
+}
+
+type signature struct {
+	keyID     []byte
+	hashed    bool
+	sig       []byte
+	trusted   string // minisign trusted comment, with the global signature covering it
+	globalSig []byte
+}
+
+// parseSignature parses a detached signature, either 64 bytes base64 encoded, or in signify or minisign format
+func parseSignature(data []byte) (*signature, error) {
+	lines := contentLines(string(data))
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("empty signature")
+	}
+	raw, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %s", err)
+	}
+	s := &signature{}
+	switch {
+	case len(raw) == ed25519.SignatureSize:
+		s.sig = raw
+	case len(raw) == 2+keyIDLen+ed25519.SignatureSize && (string(raw[:2]) == signatureAlg || string(raw[:2]) == signatureAlgHashed):
+		s.hashed = string(raw[:2]) == signatureAlgHashed
+		s.keyID, s.sig = raw[2:2+keyIDLen], raw[2+keyIDLen:]
+	default:
+		return nil, fmt.Errorf("invalid signature: neither a raw ed25519 signature nor in signify or minisign format")
+	}
+	if len(lines) >= 3 && strings.HasPrefix(lines[1], trustedPrefix) {
+		s.trusted = strings.TrimPrefix(strings.TrimPrefix(lines[1], trustedPrefix), " ")
+		if s.globalSig, err = base64.StdEncoding.DecodeString(lines[2]); err != nil {
+			return nil, fmt.Errorf("invalid global signature: %s", err)
+		}
+	}
+	return s, nil
+}
+
+// verify checks the signature of data against key, including the global signature of minisign if any
+func (s *signature) verify(key SigningKey, data []byte) bool {
+	if s.keyID != nil && key.ID != nil && !bytes.Equal(s.keyID, key.ID) {
+		return false
+	}
+	message := data
+	if s.hashed {
+		sum := blake2b.Sum512(data)
+		message = sum[:]
+	}
+	if !ed25519.Verify(key.Key, message, s.sig) {
+		return false
+	}
+	if s.globalSig != nil {
+		return ed25519.Verify(key.Key, append(append([]byte{}, s.sig...), s.trusted...), s.globalSig)
+	}
+	return true
+}
+
+// Verifier checks the detached signatures of peer lists against pinned public keys
+type Verifier struct {
+	Keys   []SigningKey
+	Suffix string // appended to the path in the url of a peer list to locate its signature, see signatureURL
+}
+
+// NewVerifier parses the pinned public keys, see ParseSigningKey, a nil Verifier is returned if there is none
+func NewVerifier(keys []string, suffix string) (*Verifier, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	v := &Verifier{Suffix: suffix}
+	if v.Suffix == "" {
+		v.Suffix = ".sig"
+	}
+	for _, k := range keys {
+		key, err := ParseSigningKey(k)
+		if err != nil {
+			return nil, err
+		}
+		v.Keys = append(v.Keys, key)
+	}
+	return v, nil
+}
+
+// Verify checks that signature is a valid signature of data made by any of the pinned keys
+func (v *Verifier) Verify(data, sig []byte) error {
+	if len(sig) == 0 {
+		return fmt.Errorf("signature missing")
+	}
+	s, err := parseSignature(sig)
+	if err != nil {
+		return err
+	}
+	for _, key := range v.Keys {
+		if s.verify(key, data) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature not made by any of the %d pinned key(s)", len(v.Keys))
+}
+
+// signatureURL locates the signature of the peer list at source, appending Suffix to the path,
+// so that the query string and the fragment, e.g. a token, are kept as is
+func (v *Verifier) signatureURL(source string) (string, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", fmt.Errorf("invalid url %s: %s", source, err)
+	}
+	u.Path += v.Suffix
+	if u.RawPath != "" {
+		u.RawPath += v.Suffix
+	}
+	return u.String(), nil
+}
+
+// fetch downloads the signature of the peer list at source
+func (v *Verifier) fetch(source string) ([]byte, error) {
+	sigURL, err := v.signatureURL(source)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := DefaultFetcher.Get(sigURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch signature: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch signature from %s: %s", sigURL, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// GenerateSigningKey generates a new ed25519 key pair for signing peer lists,
+// the private key is returned base64 encoded, as accepted by Sign
+func GenerateSigningKey() (string, SigningKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", SigningKey{}, fmt.Errorf("failed to generate key: %s", err)
+	}
+	return base64.StdEncoding.EncodeToString(priv.Seed()), SigningKey{ID: keyID(pub), Key: pub}, nil
+}
+
+// Sign signs data with the base64 encoded ed25519 private key, either the 32 bytes seed or the 64 bytes key,
+// the signature is in signify format, which can be verified with signify -V, minisign -V or Verifier
+func Sign(privateKey string, data []byte) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(privateKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %s", err)
+	}
+	var priv ed25519.PrivateKey
+	switch len(raw) {
+	case ed25519.SeedSize:
+		priv = ed25519.NewKeyFromSeed(raw)
+	case ed25519.PrivateKeySize:
+		priv = raw
+	default:
+		return nil, fmt.Errorf("invalid private key: expecting %d or %d bytes, got %d", ed25519.SeedSize, ed25519.PrivateKeySize, len(raw))
+	}
+	pub := priv.Public().(ed25519.PublicKey)
+	raw = append(append([]byte(signatureAlg), keyID(pub)...), ed25519.Sign(priv, data)...)
+	return []byte(fmt.Sprintf("%s verify with rait public key\n%s\n", commentPrefix, base64.StdEncoding.EncodeToString(raw))), nil
+}
+
+// keyID derives a stable key number for keys generated without one
+func keyID(key ed25519.PublicKey) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:keyIDLen]
+}
+
+// contentLines returns the non empty lines of s, without the untrusted comment of signify and minisign files
+func contentLines(s string) []string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, commentPrefix) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
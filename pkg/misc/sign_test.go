@@ -0,0 +1,142 @@
+package misc
+
+import (
+	"strings"
+	"testing"
+)
+
+// the test vectors are made with the key of RFC 8032 test 1, whose secret key is
+// 9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60, and the key number 5a3e9c0f7d21b468,
+// by an independent implementation of ed25519 and of the signify and minisign formats
+const (
+	testMessage = "peers {\n  public_key = \"rCOdBo/2sZlbwqTnOs8XiHbzwBI6+FVmgHNG5ZNdLmI=\"\n  name       = \"alpha\"\n}\n"
+
+	testRawKey = "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+	testKey    = "untrusted comment: signify public key\nRWRaPpwPfSG0aNdamAGCsQq31Uv+08lkBzoO4XLz2qYjJa8CGmj3B1Ea\n"
+	// the same key as generated by minisign, whose key and signature formats follow signify
+	testMinisignKey = "untrusted comment: minisign public key 68B4217D0F9C3E5A\nRWRaPpwPfSG0aNdamAGCsQq31Uv+08lkBzoO4XLz2qYjJa8CGmj3B1Ea\n"
+
+	testRawSignature     = "JOCYq28QJ575EkeF7eXGpwvqtbTU70+qZj3N8pR5SswJ4Fyml2zsL/rPKxB2Gxvz1KsJ7nwFmCo2tLKYWyEiAA==\n"
+	testSignifySignature = "untrusted comment: verify with key.pub\nRWRaPpwPfSG0aCTgmKtvECee+RJHhe3lxqcL6rW01O9PqmY9zfKUeUrMCeBcppds7C/6zysQdhsb89SrCe58BZgqNrSymFshIgA=\n"
+	// prehashed, i.e. signing the blake2b-512 hash of the message, as minisign does by default
+	testMinisignSignature = "untrusted comment: signature from minisign secret key\n" +
+		"RURaPpwPfSG0aJreyYHc/oUOmXDRkjNPI4tNX2/dBhQKGKLLhDOKyhCFz3fhkrBIdfJdZ9c3n3VOtFaM4gzJqOoTbyyHITluJAQ=\n" +
+		"trusted comment: timestamp:1600000000\tfile:peers.conf\n" +
+		"A92KFgnYMeLTsLy3HL8U9bxeB+3o6Jh5duPBTV0MyMULW70IxoMOuMu0+u6pmTQcB0l4CjDPAblPHQKB1I9bAA==\n"
+	// signing the message itself, as minisign -l does
+	testMinisignLegacySignature = "untrusted comment: signature from minisign secret key\n" +
+		"RWRaPpwPfSG0aCTgmKtvECee+RJHhe3lxqcL6rW01O9PqmY9zfKUeUrMCeBcppds7C/6zysQdhsb89SrCe58BZgqNrSymFshIgA=\n" +
+		"trusted comment: timestamp:1600000000\tfile:peers.conf\n" +
+		"hgQnPstbPcH7WwedRSz3dZVqo4ImIy/1ZGl3zMBDuWfKcyP9ulGr5a/6/gd/dGAb9czPw1vbWDaOmPf1Eny5AQ==\n"
+
+	// the public key of RFC 8032 test 2
+	testOtherKey = "PUAXw+hDiVqStwqnTRt+vJyYLM8uxJaMwM1V8Sr0Zgw="
+	// the key of the signatures, but with another key number
+	testOtherKeyIDKey = "untrusted comment: signify public key\nRWQBAgMEBQYHCNdamAGCsQq31Uv+08lkBzoO4XLz2qYjJa8CGmj3B1Ea\n"
+)
+
+func TestVerify(t *testing.T) {
+	tampered := strings.Replace(testMessage, "alpha", "alphb", 1)
+	for _, c := range []struct {
+		name      string
+		keys      []string
+		message   string
+		signature string
+		ok        bool
+	}{
+		{"raw", []string{testRawKey}, testMessage, testRawSignature, true},
+		{"raw tampered", []string{testRawKey}, tampered, testRawSignature, false},
+		{"signify", []string{testKey}, testMessage, testSignifySignature, true},
+		{"signify with raw key", []string{testRawKey}, testMessage, testSignifySignature, true},
+		{"signify tampered", []string{testKey}, tampered, testSignifySignature, false},
+		{"minisign", []string{testMinisignKey}, testMessage, testMinisignSignature, true},
+		{"minisign tampered", []string{testMinisignKey}, tampered, testMinisignSignature, false},
+		{"minisign tampered trusted comment", []string{testMinisignKey}, testMessage,
+			strings.Replace(testMinisignSignature, "1600000000", "1700000000", 1), false},
+		{"minisign legacy", []string{testMinisignKey}, testMessage, testMinisignLegacySignature, true},
+		{"minisign legacy tampered", []string{testMinisignKey}, tampered, testMinisignLegacySignature, false},
+		{"any of the keys", []string{testOtherKey, testKey}, testMessage, testSignifySignature, true},
+		{"other key", []string{testOtherKey}, testMessage, testSignifySignature, false},
+		{"other key number", []string{testOtherKeyIDKey}, testMessage, testSignifySignature, false},
+		{"missing", []string{testKey}, testMessage, "", false},
+		{"garbage", []string{testKey}, testMessage, "untrusted comment: x\nnot base64\n", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			v, err := NewVerifier(c.keys, "")
+			if err != nil {
+				t.Fatalf("NewVerifier: %s", err)
+			}
+			err = v.Verify([]byte(c.message), []byte(c.signature))
+			if c.ok && err != nil {
+				t.Errorf("expecting a valid signature, got %s", err)
+			}
+			if !c.ok && err == nil {
+				t.Errorf("expecting an invalid signature")
+			}
+		})
+	}
+}
+
+func TestSign(t *testing.T) {
+	secret, key, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatalf("GenerateSigningKey: %s", err)
+	}
+	signature, err := Sign(secret, []byte(testMessage))
+	if err != nil {
+		t.Fatalf("Sign: %s", err)
+	}
+	v, err := NewVerifier([]string{key.String()}, "")
+	if err != nil {
+		t.Fatalf("NewVerifier: %s", err)
+	}
+	if err := v.Verify([]byte(testMessage), signature); err != nil {
+		t.Errorf("expecting a valid signature, got %s", err)
+	}
+	if err := v.Verify([]byte(testMessage+"\n"), signature); err == nil {
+		t.Errorf("expecting an invalid signature of a tampered message")
+	}
+}
+
+func TestParseSigningKey(t *testing.T) {
+	for _, s := range []string{testRawKey, testKey, testMinisignKey, "RWRaPpwPfSG0aNdamAGCsQq31Uv+08lkBzoO4XLz2qYjJa8CGmj3B1Ea"} {
+		key, err := ParseSigningKey(s)
+		if err != nil {
+			t.Errorf("ParseSigningKey(%q): %s", s, err)
+			continue
+		}
+		raw, _ := ParseSigningKey(testRawKey)
+		if !key.Key.Equal(raw.Key) {
+			t.Errorf("ParseSigningKey(%q): unexpected key %s", s, key)
+		}
+	}
+	for _, s := range []string{"", "not base64", "AAAA", testRawSignature} {
+		if _, err := ParseSigningKey(s); err == nil {
+			t.Errorf("ParseSigningKey(%q): expecting an error", s)
+		}
+	}
+}
+
+func TestSignatureURL(t *testing.T) {
+	for _, c := range []struct {
+		source string
+		suffix string
+		want   string
+	}{
+		{"https://registry.example/peers.conf", ".sig", "https://registry.example/peers.conf.sig"},
+		{"https://registry.example/peers.conf?token=x", ".sig", "https://registry.example/peers.conf.sig?token=x"},
+		{"https://registry.example/peers.conf?a=1&b=2#f", ".minisig", "https://registry.example/peers.conf.minisig?a=1&b=2#f"},
+		{"https://registry.example/a%2Fb/peers.conf?token=x", ".sig", "https://registry.example/a%2Fb/peers.conf.sig?token=x"},
+		{"https://registry.example/", ".sig", "https://registry.example/.sig"},
+	} {
+		v := &Verifier{Suffix: c.suffix}
+		got, err := v.signatureURL(c.source)
+		if err != nil {
+			t.Errorf("signatureURL(%q): %s", c.source, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("signatureURL(%q) = %q, want %q", c.source, got, c.want)
+		}
+	}
+}
@@ -1,154 +1,121 @@
 package misc
 
 import (
-	"encoding/json"
+	"bytes"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"net/http"
 	"net/url"
-	"os"
+	"strings"
 
 	"github.com/BurntSushi/toml"
-	"github.com/hashicorp/hcl/v2/hclsimple"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	hcljson "github.com/hashicorp/hcl/v2/json"
 )
 
-type peerCache struct {
-	URL  string
-	Etag string
-	Data []byte
-}
-
-func loadPeerCache(path string) *peerCache {
-	p := &peerCache{}
-	p.Data = make([]byte, 0)
-	if data, err := os.ReadFile(path); err == nil {
-		if err := json.Unmarshal(data, p); err == nil {
-			return p
+// LoadPeers decodes the peer list read from path into the given interface
+// a http url is fetched with the response kept in cache, which is used when the url is unreachable,
+// and verified with its detached signature if verifier is not nil, see loadURLwithCache
+func LoadPeers(path string, cache Cache, verifier *Verifier, v interface{}) error {
+	var data []byte
+	if isHTTP(path) {
+		data = loadURLwithCache(path, cache, verifier)
+		if data == nil {
+			return fmt.Errorf("failed to load hcl from %s and cache", path)
 		}
+	} else {
+		var err error
+		if data, err = ReadAll(path); err != nil {
+			return err
+		}
+	}
+	if _, diags := DecodeHCL(path, data, v); diags.HasErrors() {
+		return fmt.Errorf("failed to decode hcl: %w", diags)
 	}
-	p.Etag = ""
-	return p
+	return nil
+}
+
+func isHTTP(path string) bool {
+	parsed, err := url.Parse(path)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https")
 }
 
-func (s *peerCache) save(path string) {
-	data, _ := json.Marshal(s)
-	if err := os.WriteFile(path, data, 0644); err != nil {
-		fmt.Printf("failed to save peer cache: %s\n", err)
+// ReadAll reads the whole content from path, see NewReadCloser for the accepted forms of path
+func ReadAll(path string) ([]byte, error) {
+	source, err := NewReadCloser(path)
+	if err != nil {
+		return nil, err
 	}
+	defer source.Close()
+
+	data, err := ioutil.ReadAll(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from %s: %s", path, err)
+	}
+	return data, nil
 }
 
-func loadURLwithCache(url, cachePath string) []byte {
-	if c := loadPeerCache(cachePath); c.Etag != "" {
-		fmt.Printf("load cache from %s\n", cachePath)
-		req, _ := http.NewRequest("GET", url, nil)
-		req.Header.Add("If-None-Match", c.Etag)
-		if resp, err := http.DefaultClient.Do(req); err == nil {
-			defer resp.Body.Close()
-			switch resp.StatusCode {
-			case http.StatusNotModified:
-				fmt.Printf("load url from %s success: %s\n", url, resp.Status)
-				return c.Data
-			case http.StatusOK:
-				c.Etag = resp.Header.Get("ETag")
-				c.URL = url
-				c.Data, _ = io.ReadAll(resp.Body)
-				if c.Etag != "" {
-					c.save(cachePath)
-				}
-				fmt.Printf("load url from %s success: %s\n", url, resp.Status)
-				return c.Data
-			default:
-				fmt.Printf("failed to load url from %s: %s, load from cache\n", url, resp.Status)
-				return c.Data
-			}
-		} else {
-			fmt.Printf("failed to load url from %s: %s, load from cache\n", url, err)
-			return c.Data
-		}
-	} else {
-		fmt.Printf("cache miss, load from %s\n", url)
-		req, _ := http.NewRequest("GET", url, nil)
-		if resp, err := http.DefaultClient.Do(req); err == nil {
-			defer resp.Body.Close()
-			switch resp.StatusCode {
-			case http.StatusOK:
-				c.Etag = resp.Header.Get("ETag")
-				c.URL = url
-				c.Data, _ = io.ReadAll(resp.Body)
-				if c.Etag != "" {
-					c.save(cachePath)
-				}
-				fmt.Errorf("load url from %s success: %s", url, resp.Status)
-				return c.Data
-			default:
-				fmt.Errorf("failed to load url from %s: %s, cache empty", url, resp.Status)
-				return nil
-			}
-		} else {
-			fmt.Errorf("failed to load url from %s: %s, cache empty", url, err)
-			return nil
-		}
+// ParseHCL parses data as hcl, naming it filename in the source ranges
+// data in json syntax is recognized by the .json extension of filename, or by starting with an object
+func ParseHCL(filename string, data []byte) (*hcl.File, hcl.Diagnostics) {
+	if IsJSON(filename, data) {
+		return hcljson.Parse(data, filename)
 	}
+	return hclsyntax.ParseConfig(data, filename, hcl.Pos{Line: 1, Column: 1})
 }
 
-func LoadPeers(path, cachePath string, v interface{}) error {
-	data := loadURLwithCache(path, cachePath)
-	if data == nil {
-		return fmt.Errorf("failed to load hcl from %s and cache", path)
+// IsJSON tells whether data named filename is hcl in json syntax
+// an object can never start a file in native syntax, so the sniffing is unambiguous
+func IsJSON(filename string, data []byte) bool {
+	if strings.HasSuffix(filename, ".json") {
+		return true
 	}
-	err := hclsimple.Decode("source.hcl", data, nil, v)
-	if err != nil {
-		return fmt.Errorf("failed to decode hcl: %s: %s", path, err)
+	trimmed := bytes.TrimSpace(data)
+	return len(trimmed) != 0 && trimmed[0] == '{'
+}
+
+// DecodeHCL parses data as hcl, naming it filename in the source ranges
+// then decodes it into the given interface as an untrusted document, see DecodeUntrustedBody
+// the parsed file is returned for further inspection
+func DecodeHCL(filename string, data []byte, v interface{}) (*hcl.File, hcl.Diagnostics) {
+	file, diags := ParseHCL(filename, data)
+	if diags.HasErrors() {
+		return file, diags
 	}
-	return nil
+	return file, append(diags, DecodeUntrustedBody(file.Body, v)...)
 }
 
-// UnmarshalHCL decodes the hcl file read from path
+// UnmarshalHCL decodes the hcl configuration read from path, see LoadHCL for the handling of fragments
 // then unmarshal it into the given interface
+// the returned error wraps hcl.Diagnostics when decoding fails
 func UnmarshalHCL(path string, v interface{}) error {
-	var err error
-	var data []byte
-	if _, err := url.Parse(path); err != nil {
-		resp, err := http.Get(path)
-		if err != nil {
-			return fmt.Errorf("failed to load hcl from %s: %s", path, err)
-		}
-		defer resp.Body.Close()
-		if data, err = ioutil.ReadAll(resp.Body); err != nil {
-			return fmt.Errorf("failed to load hcl from %s: %s", path, err)
-		}
-	} else {
-		source, err := NewReadCloser(path)
-		if err != nil {
-			return err
-		}
-		defer source.Close()
-
-		data, err = ioutil.ReadAll(source)
-		if err != nil {
-			return err
-		}
+	body, diags := LoadHCL(path)
+	if !diags.HasErrors() {
+		diags = append(diags, DecodeBody(body, BaseDir(path), v)...)
 	}
-	err = hclsimple.Decode("source.hcl", data, nil, v)
-	if err != nil {
-		return fmt.Errorf("failed to decode hcl: %s: %s", path, err)
+	if diags.HasErrors() {
+		return fmt.Errorf("failed to decode hcl: %w", diags)
 	}
 	return nil
 }
 
 // UnmarshalTOML decodes the toml file read from path
 // then unmarshal it into the given interface
-func UnmarshalTOML(path string, v interface{}) error {
+// the keys which do not correspond to any field are returned
+func UnmarshalTOML(path string, v interface{}) ([]string, error) {
 	source, err := NewReadCloser(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer source.Close()
 
-	_, err = toml.DecodeReader(source, v)
+	meta, err := toml.DecodeReader(source, v)
 	if err != nil {
-		return fmt.Errorf("failed to decode toml: %s: %s", path, err)
+		return nil, fmt.Errorf("failed to decode toml: %s: %s", path, err)
 	}
-	return nil
+	var undecoded []string
+	for _, key := range meta.Undecoded() {
+		undecoded = append(undecoded, key.String())
+	}
+	return undecoded, nil
 }
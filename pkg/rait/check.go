@@ -0,0 +1,403 @@
+package rait
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Catofes/RAIT/v4/pkg/misc"
+
+	"github.com/hashicorp/hcl/v2"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Check decodes rait.conf from path, see NewRAIT for the accepted forms of path, and the peer lists it refers to, then validates all of them
+// peers overrides the peer list locations from rait.conf if not empty
+// all the problems found are returned as diagnostics, carrying the source range whenever possible
+func Check(path, peers string) hcl.Diagnostics {
+	var sources []string
+	if peers != "" {
+		sources = []string{peers}
+	}
+	r := defaultRAIT()
+	body, diags := misc.LoadHCL(path)
+	if !diags.HasErrors() {
+		decodeDiags := misc.DecodeBody(body, misc.BaseDir(path), r)
+		diags = append(diags, decodeDiags...)
+		if !decodeDiags.HasErrors() {
+			diags = append(diags, r.Validate(body)...)
+			if peers == "" {
+				sources, _ = r.PeerSources() // reported by Validate
+			}
+			if r.Fetch != nil {
+				if fetcher, err := r.Fetch.Fetcher(); err == nil { // reported by Validate
+					misc.DefaultFetcher = fetcher
+				}
+			}
+			if r.Resolver != nil {
+				if resolver, err := r.Resolver.resolver(); err == nil { // reported by Validate
+					misc.DefaultResolver = resolver
+				}
+			}
+		}
+	}
+
+	for _, source := range sources {
+		p := &Peers{}
+		read := misc.ReadAll
+		if isDNSSource(source) {
+			read = discoverPeers
+		}
+		data, err := read(source)
+		if err != nil {
+			diags = append(diags, readFailure(err))
+			continue
+		}
+		file, decodeDiags := misc.DecodeHCL(source, data, p)
+		diags = append(diags, decodeDiags...)
+		if !decodeDiags.HasErrors() {
+			diags = append(diags, p.Validate(file.Body)...)
+		}
+	}
+	return diags
+}
+
+func readFailure(err error) *hcl.Diagnostic {
+	return &hcl.Diagnostic{
+		Severity: hcl.DiagError,
+		Summary:  "Failed to read file",
+		Detail:   err.Error(),
+	}
+}
+
+// Validate checks the semantics of the decoded rait.conf, body is the source it is decoded from
+func (r *RAIT) Validate(body hcl.Body) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	root := newLocator(body)
+	if r.NodeID != "" {
+		if err := validateNodeID(r.NodeID); err != nil {
+			diags = append(diags, root.errorf("node_id", "%s", err))
+		}
+	}
+	if _, err := r.PeerSources(); err != nil {
+		diags = append(diags, root.errorf("peers", "%s", err))
+	}
+	if _, err := r.Verifier(); err != nil {
+		diags = append(diags, root.block("peer_signature", 0).errorf("public_keys", "%s", err))
+	}
+	if _, err := r.PeerCache(); err != nil {
+		diags = append(diags, root.errorf("cache_max_stale", "%s", err))
+	}
+	if err := r.Filter.validate(); err != nil {
+		diags = append(diags, root.block("peer_filter", 0).errorf("", "%s", err))
+	}
+	if r.Fetch != nil {
+		if _, err := r.Fetch.Fetcher(); err != nil {
+			diags = append(diags, root.block("fetch", 0).errorf("", "%s", err))
+		}
+	}
+	if r.Resolver != nil {
+		if _, err := r.Resolver.resolver(); err != nil {
+			diags = append(diags, root.block("resolver", 0).errorf("", "%s", err))
+		}
+	}
+	if _, err := r.PSK.load(); err != nil {
+		diags = append(diags, root.block("preshared_key", 0).errorf("", "%s", err))
+	}
+	if len(r.Transport) == 0 {
+		diags = append(diags, root.errorf("", "at least one transport block is required"))
+	}
+
+	names := make(map[string]int)
+	ports := make(map[string]int)
+	for i, template := range r.Transport {
+		loc := root.block("transport", i)
+		diags = append(diags, template.validatePrivateKey(loc)...)
+		expanded, err := template.expand()
+		if err != nil {
+			diags = append(diags, loc.errorf("", "%s", err))
+			continue
+		}
+		for _, t := range expanded {
+			tloc := loc
+			if len(template.AddressFamilies) != 0 {
+				tloc = loc.labeled("override", t.AddressFamily).within(loc)
+			}
+			diags = append(diags, t.validate(tloc)...)
+			wg, vxlan := t.linkNames()
+			for _, link := range []struct{ name, attr, template string }{
+				{wg, "wg_ifname", t.WgIFName},
+				{vxlan, "vxlan_ifname", t.VxlanIFName},
+			} {
+				attr := link.attr
+				switch {
+				case link.name == wg && t.WgGoInterface != "":
+					attr = "go_interface"
+				case link.template == "":
+					attr = "ifprefix" // derived from the default template
+				}
+				if err := misc.ValidateIFName(link.name); err != nil {
+					diags = append(diags, tloc.errorf(attr, "%s", err))
+				} else if j, ok := names[link.name]; ok {
+					diags = append(diags, tloc.errorf(attr, "interface name %s is already used by transport #%d", link.name, j+1))
+				} else {
+					names[link.name] = i
+				}
+			}
+			// wireguard listens on both address families, so ports only have to differ per bind address
+			socket := net.JoinHostPort(t.BindAddress, fmt.Sprint(t.Port))
+			if j, ok := ports[socket]; ok {
+				diags = append(diags, tloc.errorf("port", "port %d is already used by transport #%d", t.Port, j+1))
+			} else {
+				ports[socket] = i
+			}
+		}
+	}
+
+	if r.Isolation != nil {
+		loc := root.block("isolation", 0)
+		if r.Isolation.IFGroup <= 0 {
+			// links in group 0 are not managed by rait, everything would be considered ours
+			diags = append(diags, loc.errorf("ifgroup", "ifgroup must be a positive integer, got %d", r.Isolation.IFGroup))
+		}
+	}
+
+	if r.Babeld != nil {
+		loc := root.block("babeld", 0)
+		if r.Babeld.SocketType != "unix" && r.Babeld.SocketType != "tcp" {
+			diags = append(diags, loc.errorf("socket_type", "socket_type must be unix or tcp, got %s", r.Babeld.SocketType))
+		}
+		if r.Babeld.SocketAddr == "" {
+			diags = append(diags, loc.errorf("socket_addr", "socket_addr must not be empty"))
+		}
+	}
+	return diags
+}
+
+// validate checks the semantics of a single transport, after the expansion of templates
+func (t *Transport) validate(loc locator) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	if _, err := misc.ParseAF(t.AddressFamily); err != nil {
+		diags = append(diags, loc.errorf("address_family", "%s, expecting ip4 or ip6", err))
+	}
+	if t.Port < 1 || t.Port > 65535 {
+		diags = append(diags, loc.errorf("port", "port must be within 1-65535, got %d", t.Port))
+	}
+	// the vxlan interface takes 70 bytes off and carries ipv6 link local traffic, which requires 1280
+	if t.MTU < 1350 || t.MTU > 65535 {
+		diags = append(diags, loc.errorf("mtu", "mtu must be within 1350-65535, got %d", t.MTU))
+	}
+	if t.IFPrefix == "" {
+		diags = append(diags, loc.errorf("ifprefix", "ifprefix must not be empty"))
+	}
+	if t.InnerAddress != "" {
+		if ip, network, err := net.ParseCIDR(t.InnerAddress); err != nil {
+			diags = append(diags, loc.errorf("inner_address", "invalid inner address: %s", err))
+		} else if ones, _ := network.Mask.Size(); ip.To4() != nil && ones == 32 {
+			// the peers are only reachable through the prefix, as each of them is allowed a single address
+			diags = append(diags, loc.errorf("inner_address", "ipv4 inner address %s must have a prefix covering the inner addresses of the peers, e.g. /24", t.InnerAddress))
+		}
+	}
+	if t.Mac != "" {
+		if _, err := net.ParseMAC(t.Mac); err != nil {
+			diags = append(diags, loc.errorf("mac", "invalid mac address: %s", err))
+		}
+	}
+	if t.VNI < 0 || t.VNI > 1<<24-1 {
+		diags = append(diags, loc.errorf("vni", "vni must be within 0-16777215, got %d", t.VNI))
+	}
+	if t.BindAddress != "" && net.ParseIP(t.BindAddress) == nil {
+		diags = append(diags, loc.errorf("bind_addr", "invalid bind address %s", t.BindAddress))
+	}
+	if t.FwMark < 0 {
+		diags = append(diags, loc.errorf("fwmark", "fwmark must not be negative, got %d", t.FwMark))
+	}
+	if t.Keepalive < 0 || t.Keepalive > 65535 {
+		diags = append(diags, loc.errorf("keepalive", "keepalive must be within 0-65535 seconds, got %d", t.Keepalive))
+	}
+	return diags
+}
+
+// validatePrivateKey checks the private key source, keys not available on this machine only produce a warning
+func (t *Transport) validatePrivateKey(loc locator) hcl.Diagnostics {
+	secret := t.privateKeySecret()
+	attr := "private_key"
+	switch {
+	case secret.File != "":
+		attr = "private_key_file"
+	case secret.Env != "":
+		attr = "private_key_env"
+	case secret.Credential != "":
+		attr = "private_key_credential"
+	}
+	switch secret.Sources() {
+	case 0:
+		return hcl.Diagnostics{loc.errorf("", "one of private_key, private_key_file, private_key_env or private_key_credential is required")}
+	case 1:
+	default:
+		return hcl.Diagnostics{loc.errorf(attr, "only one of private_key, private_key_file, private_key_env or private_key_credential is allowed")}
+	}
+	key, err := secret.Resolve()
+	if err != nil {
+		diag := loc.errorf(attr, "private key not checked: %s", err)
+		diag.Severity = hcl.DiagWarning
+		return hcl.Diagnostics{diag}
+	}
+	if _, err := wgtypes.ParseKey(key); err != nil {
+		return hcl.Diagnostics{loc.errorf(attr, "invalid private key: %s", err)}
+	}
+	return nil
+}
+
+// Validate checks the semantics of the decoded peer list, body is the source it is decoded from
+func (p *Peers) Validate(body hcl.Body) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	root := newLocator(body)
+	for _, key := range p.Revoked {
+		if _, err := wgtypes.ParseKey(key); err != nil {
+			diags = append(diags, root.errorf("revoked", "invalid public key %s: %s", key, err))
+		}
+	}
+	for i, peer := range p.Peers {
+		diags = append(diags, peer.validate(root.block("peers", i))...)
+	}
+	return diags
+}
+
+// validate checks the semantics of a single peer together with its endpoints
+func (s *Peer) validate(loc locator) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	if _, err := wgtypes.ParseKey(s.PublicKey); err != nil {
+		diags = append(diags, loc.errorf("public_key", "invalid public key: %s", err))
+	}
+	windowValid := true
+	for _, t := range []struct{ attr, value string }{{"not_before", s.NotBefore}, {"not_after", s.NotAfter}} {
+		if _, err := time.Parse(time.RFC3339, t.value); t.value != "" && err != nil {
+			diags = append(diags, loc.errorf(t.attr, "invalid %s, expecting RFC 3339 time: %s", t.attr, err))
+			windowValid = false
+		}
+	}
+	if s.NodeID != "" {
+		if err := validateNodeID(s.NodeID); err != nil {
+			diags = append(diags, loc.errorf("node_id", "%s", err))
+		}
+	}
+	if _, _, err := s.validity(); windowValid && err != nil {
+		diags = append(diags, loc.errorf("not_after", "%s", err))
+	}
+	if len(s.Endpoint) == 0 {
+		diags = append(diags, loc.errorf("", "at least one endpoint block is required"))
+	}
+	families := make(map[string]int)
+	for i, endpoint := range s.Endpoint {
+		eloc := loc.block("endpoint", i)
+		diags = append(diags, endpoint.validate(eloc)...)
+		af, err := misc.ParseAF(endpoint.AddressFamily)
+		if err != nil {
+			continue // reported by Endpoint.validate
+		}
+		if j, ok := families[af]; ok {
+			diags = append(diags, eloc.errorf("address_family", "address family %s is already used by endpoint #%d", af, j+1))
+		} else {
+			families[af] = i
+		}
+	}
+	return diags
+}
+
+// validate checks the semantics of a single endpoint block
+func (e *Endpoint) validate(loc locator) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	if _, err := misc.ParseAF(e.AddressFamily); err != nil {
+		diags = append(diags, loc.errorf("address_family", "%s, expecting ip4 or ip6", err))
+	}
+	if e.Port < 1 || e.Port > 65535 {
+		diags = append(diags, loc.errorf("port", "port must be within 1-65535, got %d", e.Port))
+	}
+	if e.Mac != "" {
+		if _, err := net.ParseMAC(e.Mac); err != nil {
+			diags = append(diags, loc.errorf("mac", "invalid mac address: %s", err))
+		}
+	}
+	if e.InnerAddress != "" {
+		if _, _, err := net.ParseCIDR(e.InnerAddress); err != nil {
+			diags = append(diags, loc.errorf("inner_address", "invalid inner address: %s", err))
+		}
+	}
+	if e.Keepalive < 0 || e.Keepalive > 65535 {
+		diags = append(diags, loc.errorf("keepalive", "keepalive must be within 0-65535 seconds, got %d", e.Keepalive))
+	}
+	return diags
+}
+
+// locator finds the source ranges of blocks and attributes in a decoded body
+// so that semantic errors can point to the exact location of the offending value
+type locator struct {
+	body     hcl.Body
+	rng      hcl.Range
+	fallback *locator
+}
+
+func newLocator(body hcl.Body) locator {
+	return locator{body: body, rng: body.MissingItemRange()}
+}
+
+// block returns the locator of the index-th block of the given type, or itself if there is no such block
+func (l locator) block(typ string, index int) locator {
+	if l.body == nil {
+		return l
+	}
+	content, _, _ := l.body.PartialContent(&hcl.BodySchema{Blocks: []hcl.BlockHeaderSchema{{Type: typ}}})
+	blocks := content.Blocks.OfType(typ)
+	if index >= len(blocks) {
+		return l
+	}
+	return locator{body: blocks[index].Body, rng: blocks[index].DefRange}
+}
+
+// labeled returns the locator of the first block of the given type with the given label, or itself if there is no such block
+func (l locator) labeled(typ string, label string) locator {
+	if l.body == nil {
+		return l
+	}
+	content, _, _ := l.body.PartialContent(&hcl.BodySchema{Blocks: []hcl.BlockHeaderSchema{{Type: typ, LabelNames: []string{"label"}}}})
+	for _, block := range content.Blocks.OfType(typ) {
+		if block.Labels[0] == label {
+			return locator{body: block.Body, rng: block.DefRange}
+		}
+	}
+	return l
+}
+
+// within makes attributes not found in the block looked up in parent, e.g. overrides of a template
+func (l locator) within(parent locator) locator {
+	if l.body == parent.body {
+		return l
+	}
+	l.fallback = &parent
+	return l
+}
+
+// attr returns the range of the value of the named attribute, falling back to the range of the block
+func (l locator) attr(name string) hcl.Range {
+	if l.body == nil || name == "" {
+		return l.rng
+	}
+	content, _, _ := l.body.PartialContent(&hcl.BodySchema{Attributes: []hcl.AttributeSchema{{Name: name}}})
+	if attr, ok := content.Attributes[name]; ok {
+		return attr.Expr.Range()
+	}
+	if l.fallback != nil {
+		return l.fallback.attr(name)
+	}
+	return l.rng
+}
+
+func (l locator) errorf(attr string, format string, args ...interface{}) *hcl.Diagnostic {
+	rng := l.attr(attr)
+	return &hcl.Diagnostic{
+		Severity: hcl.DiagError,
+		Summary:  fmt.Sprintf(format, args...),
+		Subject:  &rng,
+	}
+}
@@ -1,39 +1,78 @@
 package rait
 
 import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
 	"github.com/Catofes/RAIT/v4/pkg/misc"
 
 	"github.com/hashicorp/hcl/v2"
-	"github.com/hashicorp/hcl/v2/gohcl"
-	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	"github.com/zclconf/go-cty/cty/gocty"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 // RAIT is the model corresponding to rait.conf, for default value of fields, see NewRAIT
 type RAIT struct {
-	Name       string      `hcl:"name,optional"` // optional, human readable node name
-	Peers      string      `hcl:"peers,attr"`    // mandatory, list of peers, in hcl format
-	CachePeers string      `hcl:"cache_peers,optional"`
-	Transport  []Transport `hcl:"transport,block"` // mandatory, underlying transport for wireguard sockets
-	Isolation  *Isolation  `hcl:"isolation,block"` // optional, params for the separation of underlay and overlay
-	Babeld     *Babeld     `hcl:"babeld,block"`    // optional, integration with babeld
-	Remarks    hcl.Body    `hcl:"remarks,remain"`  // optional, additional information
+	Name       string        `hcl:"name,optional"`            // optional, human readable node name
+	NodeID     string        `hcl:"node_id,optional"`         // optional, stable identity of the node, carried in its published records, the public key of the first transport by default
+	Peers      cty.Value     `hcl:"peers,attr"`               // mandatory, location of the peer list, in hcl format, or a list of them, see PeerSources
+	CachePeers string        `hcl:"cache_peers,optional"`     // optional, cache file of the peer lists fetched over http
+	CacheStale string        `hcl:"cache_max_stale,optional"` // optional, age after which the cache is refused, e.g. 72h, unlimited by default
+	Signature  *Signature    `hcl:"peer_signature,block"`     // optional, verification of the peer lists fetched over http
+	Fetch      *Fetch        `hcl:"fetch,block"`              // optional, http client settings, for peer lists and the like
+	Filter     *PeerFilter   `hcl:"peer_filter,block"`        // optional, selection of the peers to connect to
+	Resolver   *Resolver     `hcl:"resolver,block"`           // optional, dns settings for peers discovered from dns
+	PSK        *PresharedKey `hcl:"preshared_key,block"`      // optional, wireguard preshared keys of the peers
+	Transport  []Transport   `hcl:"transport,block"`          // mandatory, underlying transport for wireguard sockets
+	Isolation  *Isolation    `hcl:"isolation,block"`          // optional, params for the separation of underlay and overlay
+	Babeld     *Babeld       `hcl:"babeld,block"`             // optional, integration with babeld
+	Remarks    hcl.Body      `hcl:"remarks,remain"`           // optional, additional information
+
+	evalContext *hcl.EvalContext
+	psk         *presharedKeys
 }
 
 type Transport struct {
-	PrivateKey    string `hcl:"private_key,attr"`       // mandatory, wireguard private key, base64 encoded
-	AddressFamily string `hcl:"address_family,attr"`    // mandatory, socket address family, ip4 or ip6
-	Port          int    `hcl:"port,attr"`              // mandatory, socket listen port
-	MTU           int    `hcl:"mtu,attr"`               // mandatory, interface mtu
-	IFPrefix      string `hcl:"ifprefix,attr"`          // mandatory, interface naming prefix, should not collide between transports
-	InnerAddress  string `hcl:"inner_address,optional"` //optional, interface inner ip, should not collide in a network
+	PrivateKey           string `hcl:"private_key,optional"`            // mandatory unless loaded from other sources, wireguard private key, base64 encoded
+	PrivateKeyFile       string `hcl:"private_key_file,optional"`       // optional, file to load private key from
+	PrivateKeyEnv        string `hcl:"private_key_env,optional"`        // optional, environment variable to load private key from
+	PrivateKeyCredential string `hcl:"private_key_credential,optional"` // optional, systemd credential to load private key from
+	AddressFamily        string `hcl:"address_family,optional"`         // mandatory unless address_families is set, socket address family, ip4 or ip6
+	Port                 int    `hcl:"port,attr"`                       // mandatory, socket listen port
+	MTU                  int    `hcl:"mtu,attr"`                        // mandatory, interface mtu
+	IFPrefix             string `hcl:"ifprefix,attr"`                   // mandatory, interface naming prefix, should not collide between transports
+	InnerAddress         string `hcl:"inner_address,optional"`          //optional, interface inner ip, should not collide in a network
+	Mac                  string `hcl:"mac,optional"`
+	VNI                  int    `hcl:"vni"`
+	Address              string `hcl:"address,optional"`      // optional, public ip address or resolvable domain name
+	BindAddress          string `hcl:"bind_addr,optional"`    // optional, socket bind address, only has effect when -b is set
+	FwMark               int    `hcl:"fwmark,optional"`       // optional, fwmark set on out going packets
+	Keepalive            int    `hcl:"keepalive,optional"`    // optional, persistent keepalive interval in seconds, for nodes behind nat, disabled by default
+	RandomPort           bool   `hcl:"random_port,optional"`  // optional, whether to randomize listen port
+	WgGoInterface        string `hcl:"go_interface,optional"` // optional, use userspace wireguard instead of kernel module
+	WgIFName             string `hcl:"wg_ifname,optional"`    // optional, wireguard interface name template, see linkNames
+	VxlanIFName          string `hcl:"vxlan_ifname,optional"` // optional, vxlan interface name template, see linkNames
+
+	AddressFamilies []string            `hcl:"address_families,optional"` // optional, make the block a template expanded into one transport per address family
+	Override        []TransportOverride `hcl:"override,block"`            // optional, per address family overrides of a template
+}
+
+// TransportOverride overrides the fields of a transport template for the address family in its label
+// ifprefix defaults to the ifprefix of the template suffixed with 4 or 6
+type TransportOverride struct {
+	AddressFamily string `hcl:"address_family,label"`
+	Port          int    `hcl:"port,optional"`
+	MTU           int    `hcl:"mtu,optional"`
+	IFPrefix      string `hcl:"ifprefix,optional"`
+	InnerAddress  string `hcl:"inner_address,optional"`
 	Mac           string `hcl:"mac,optional"`
-	VNI           int    `hcl:"vni"`
-	Address       string `hcl:"address,optional"`      // optional, public ip address or resolvable domain name
-	BindAddress   string `hcl:"bind_addr,optional"`    // optional, socket bind address, only has effect when -b is set
-	FwMark        int    `hcl:"fwmark,optional"`       // optional, fwmark set on out going packets
-	RandomPort    bool   `hcl:"random_port,optional"`  // optional, whether to randomize listen port
-	WgGoInterface string `hcl:"go_interface,optional"` // optional, use userspace wireguard instead of kernel module
+	Address       string `hcl:"address,optional"`
+	BindAddress   string `hcl:"bind_addr,optional"`
+	Keepalive     int    `hcl:"keepalive,optional"`
 }
 
 type Isolation struct {
@@ -42,6 +81,96 @@ type Isolation struct {
 	Target  string `hcl:"target,optional"`  // optional, the namespace to move interfaces into
 }
 
+// Signature pins the keys the peer lists are signed with, see misc.Verifier
+type Signature struct {
+	PublicKeys []string `hcl:"public_keys,attr"` // mandatory, ed25519 public keys, base64 encoded or in signify or minisign format
+	Suffix     string   `hcl:"suffix,optional"`  // optional, appended to the path in the url of a peer list to locate its signature, .sig by default
+}
+
+// Fetch is the settings of the http client, see misc.Fetcher
+type Fetch struct {
+	Timeout        string      `hcl:"timeout,optional"`         // optional, timeout of a request as a whole, 30s by default
+	ConnectTimeout string      `hcl:"connect_timeout,optional"` // optional, timeout of establishing connections, 30s by default
+	Retries        int         `hcl:"retries,optional"`         // optional, additional attempts on network or server errors
+	Backoff        string      `hcl:"backoff,optional"`         // optional, delay before the first retry, doubled after each retry, 1s by default
+	CABundle       string      `hcl:"ca_bundle,optional"`       // optional, pem file of certificates trusted instead of the system ones
+	ClientCert     string      `hcl:"client_cert,optional"`     // optional, pem file of the client certificate for mutual tls
+	ClientKey      string      `hcl:"client_key,optional"`      // optional, pem file of the private key of client_cert
+	Auth           []FetchAuth `hcl:"auth,block"`               // optional, credentials and headers, each sent to the urls under its prefix only
+	Proxy          string      `hcl:"proxy,optional"`           // optional, proxy url, http_proxy and the like are honoured if not set
+}
+
+// FetchAuth is the credentials and the headers sent to the urls starting with URLPrefix, see misc.FetchScope
+type FetchAuth struct {
+	URLPrefix             string            `hcl:"url_prefix,attr"`                   // mandatory, e.g. https://registry.example/private/, the scheme and the host must match exactly
+	BearerToken           string            `hcl:"bearer_token,optional"`             // optional, token sent in the authorization header
+	BearerTokenFile       string            `hcl:"bearer_token_file,optional"`        // optional, file to load bearer_token from
+	BasicAuthUsername     string            `hcl:"basic_auth_username,optional"`      // optional, username of http basic authentication
+	BasicAuthPassword     string            `hcl:"basic_auth_password,optional"`      // optional, password of http basic authentication
+	BasicAuthPasswordFile string            `hcl:"basic_auth_password_file,optional"` // optional, file to load basic_auth_password from
+	Headers               map[string]string `hcl:"headers,optional"`                  // optional, additional headers
+}
+
+// Fetcher builds the http client configured in the fetch block, see misc.DefaultFetcher
+func (f *Fetch) Fetcher() (*misc.Fetcher, error) {
+	auth := make([]misc.FetchAuth, 0, len(f.Auth))
+	for _, a := range f.Auth {
+		token, err := misc.Secret{Inline: a.BearerToken, File: a.BearerTokenFile}.Resolve()
+		if err != nil {
+			return nil, fmt.Errorf("fetch: auth %s: bearer_token: %s", a.URLPrefix, err)
+		}
+		password, err := misc.Secret{Inline: a.BasicAuthPassword, File: a.BasicAuthPasswordFile}.Resolve()
+		if err != nil {
+			return nil, fmt.Errorf("fetch: auth %s: basic_auth_password: %s", a.URLPrefix, err)
+		}
+		auth = append(auth, misc.FetchAuth{
+			URLPrefix:   a.URLPrefix,
+			BearerToken: token,
+			Username:    a.BasicAuthUsername,
+			Password:    password,
+			Header:      a.Headers,
+		})
+	}
+	fetcher, err := misc.NewFetcher(misc.FetchOptions{
+		Timeout:        f.Timeout,
+		ConnectTimeout: f.ConnectTimeout,
+		Retries:        f.Retries,
+		Backoff:        f.Backoff,
+		CABundle:       f.CABundle,
+		ClientCert:     f.ClientCert,
+		ClientKey:      f.ClientKey,
+		Auth:           auth,
+		Proxy:          f.Proxy,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetch: %s", err)
+	}
+	return fetcher, nil
+}
+
+// Resolver is the settings of the dns resolver, see misc.Resolver
+type Resolver struct {
+	Address string `hcl:"address,optional"` // optional, host:port of the dns server, those of the system by default
+	Timeout string `hcl:"timeout,optional"` // optional, timeout of a discovery as a whole, 10s by default
+}
+
+// resolver builds the dns resolver configured in the resolver block
+func (r *Resolver) resolver() (*misc.Resolver, error) {
+	var timeout time.Duration
+	if r.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(r.Timeout); err != nil {
+			return nil, fmt.Errorf("resolver: invalid timeout: %s", err)
+		}
+	}
+	if r.Address != "" {
+		if _, _, err := net.SplitHostPort(r.Address); err != nil {
+			return nil, fmt.Errorf("resolver: invalid address: %s", err)
+		}
+	}
+	return misc.NewResolver(r.Address, timeout), nil
+}
+
 type Babeld struct {
 	SocketType     string   `hcl:"socket_type,optional"`     // optional, control socket type, tcp or unix
 	SocketAddr     string   `hcl:"socket_addr,optional"`     // optional, control socket address
@@ -50,9 +179,153 @@ type Babeld struct {
 	ExtraCmd       string   `hcl:"extra_cmd,optional"`       // optional, additional command passed to socket at the end of sync
 }
 
+// NewRAIT loads rait.conf from path, which can also be a directory of fragments, see misc.LoadHCL for the merging rules
+// the http client configured in the fetch block, if any, becomes misc.DefaultFetcher for the requests afterwards,
+// and likewise the resolver block for misc.DefaultResolver
 func NewRAIT(path string) (*RAIT, error) {
-	var r = &RAIT{
-		Peers:      "/etc/higgs/peers.conf",
+	var r = defaultRAIT()
+	if err := misc.UnmarshalHCL(path, r); err != nil {
+		return nil, err
+	}
+	if _, err := r.PeerSources(); err != nil {
+		return nil, err
+	}
+	if _, err := r.Verifier(); err != nil {
+		return nil, err
+	}
+	if _, err := r.PeerCache(); err != nil {
+		return nil, err
+	}
+	if err := r.Filter.validate(); err != nil {
+		return nil, err
+	}
+	if r.Fetch != nil {
+		fetcher, err := r.Fetch.Fetcher()
+		if err != nil {
+			return nil, err
+		}
+		misc.DefaultFetcher = fetcher
+	}
+	if r.Resolver != nil {
+		resolver, err := r.Resolver.resolver()
+		if err != nil {
+			return nil, err
+		}
+		misc.DefaultResolver = resolver
+	}
+	psk, err := r.PSK.load()
+	if err != nil {
+		return nil, err
+	}
+	r.psk = psk
+	var transports []Transport
+	for _, t := range r.Transport {
+		if err := t.resolvePrivateKey(); err != nil {
+			return nil, err
+		}
+		expanded, err := t.expand()
+		if err != nil {
+			return nil, err
+		}
+		transports = append(transports, expanded...)
+	}
+	r.Transport = transports
+	if err := r.resolveNodeID(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// resolveNodeID defaults node_id to the public key of the first transport, so that the router id derived from it,
+// see RouterID, stays the same as before node_id is introduced
+func (r *RAIT) resolveNodeID() error {
+	if r.NodeID != "" {
+		return validateNodeID(r.NodeID)
+	}
+	if len(r.Transport) == 0 {
+		return nil
+	}
+	privateKey, err := wgtypes.ParseKey(r.Transport[0].PrivateKey)
+	if err != nil {
+		return fmt.Errorf("transport %s: failed to parse private key: %s", r.Transport[0].IFPrefix, err)
+	}
+	r.NodeID = privateKey.PublicKey().String()
+	return nil
+}
+
+func validateNodeID(id string) error {
+	if strings.TrimSpace(id) != id || strings.ContainsAny(id, "\n\r") {
+		return fmt.Errorf("invalid node_id %q: surrounding whitespaces and line breaks are not allowed", id)
+	}
+	return nil
+}
+
+// RouterID returns the babeld router id of the node, derived from its node_id, see RouterID
+func (r *RAIT) RouterID() string {
+	return RouterID(r.NodeID)
+}
+
+// SetEvalContext keeps the evaluation context for querying remarks
+func (r *RAIT) SetEvalContext(ctx *hcl.EvalContext) {
+	r.evalContext = ctx
+}
+
+// PeerSources returns the locations of the peer lists, peers may be a single location or a list of them
+// see NewPeers for how the lists are merged
+func (r *RAIT) PeerSources() ([]string, error) {
+	if r.Peers.Type() == cty.NilType || r.Peers.IsNull() {
+		return nil, fmt.Errorf("peers must not be empty")
+	}
+	value := r.Peers
+	if value.Type() == cty.String {
+		value = cty.TupleVal([]cty.Value{value})
+	}
+	value, err := convert.Convert(value, cty.List(cty.String))
+	if err != nil {
+		return nil, fmt.Errorf("peers must be a string or a list of strings: %s", err)
+	}
+	var sources []string
+	if err := gocty.FromCtyValue(value, &sources); err != nil {
+		return nil, fmt.Errorf("peers must be a string or a list of strings: %s", err)
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("peers must not be empty")
+	}
+	for _, source := range sources {
+		if source == "" {
+			return nil, fmt.Errorf("peers must not contain empty locations")
+		}
+	}
+	return sources, nil
+}
+
+// PeerCache returns the cache of the peer lists, see misc.Cache
+func (r *RAIT) PeerCache() (misc.Cache, error) {
+	cache := misc.Cache{Path: r.CachePeers}
+	if r.CacheStale != "" {
+		maxStale, err := time.ParseDuration(r.CacheStale)
+		if err != nil {
+			return cache, fmt.Errorf("invalid cache_max_stale: %s", err)
+		}
+		cache.MaxStale = maxStale
+	}
+	return cache, nil
+}
+
+// Verifier returns the verifier of the peer lists, nil if they are not signed
+func (r *RAIT) Verifier() (*misc.Verifier, error) {
+	if r.Signature == nil {
+		return nil, nil
+	}
+	if len(r.Signature.PublicKeys) == 0 {
+		return nil, fmt.Errorf("peer_signature: public_keys must not be empty")
+	}
+	return misc.NewVerifier(r.Signature.PublicKeys, r.Signature.Suffix)
+}
+
+func defaultRAIT() *RAIT {
+	return &RAIT{
+		Peers:      cty.StringVal("/etc/higgs/peers.conf"),
 		CachePeers: "/run/higgs/peers.cache",
 		Isolation: &Isolation{
 			IFGroup: 54,
@@ -63,41 +336,190 @@ func NewRAIT(path string) (*RAIT, error) {
 			Param:      "type tunnel link-quality true split-horizon false rxcost 32 hello-interval 20 max-rtt-penalty 1024 rtt-max 1024",
 		},
 	}
-	if err := misc.UnmarshalHCL(path, r); err != nil {
-		return nil, err
+}
+
+func (t *Transport) privateKeySecret() misc.Secret {
+	return misc.Secret{
+		Inline:     t.PrivateKey,
+		File:       t.PrivateKeyFile,
+		Env:        t.PrivateKeyEnv,
+		Credential: t.PrivateKeyCredential,
+	}
+}
+
+// resolvePrivateKey loads the private key from the configured source into PrivateKey
+func (t *Transport) resolvePrivateKey() error {
+	secret := t.privateKeySecret()
+	if secret.Sources() == 0 {
+		return fmt.Errorf("transport %s: no private key specified", t.IFPrefix)
+	}
+	key, err := secret.Resolve()
+	if err != nil {
+		return fmt.Errorf("transport %s: failed to load private key: %s", t.IFPrefix, err)
+	}
+	t.PrivateKey = key
+	return nil
+}
+
+// expand turns a transport template into one transport per address family, applying the overrides
+// a plain transport is returned as is
+func (t Transport) expand() ([]Transport, error) {
+	if len(t.AddressFamilies) == 0 {
+		if len(t.Override) != 0 {
+			return nil, fmt.Errorf("transport %s: override is only allowed together with address_families", t.IFPrefix)
+		}
+		return []Transport{t}, nil
+	}
+	if t.AddressFamily != "" {
+		return nil, fmt.Errorf("transport %s: address_family and address_families are mutually exclusive", t.IFPrefix)
+	}
+
+	overrides := make(map[string]TransportOverride)
+	for _, o := range t.Override {
+		if !misc.StringIn(t.AddressFamilies, o.AddressFamily) {
+			return nil, fmt.Errorf("transport %s: override %s is not listed in address_families", t.IFPrefix, o.AddressFamily)
+		}
+		if _, ok := overrides[o.AddressFamily]; ok {
+			return nil, fmt.Errorf("transport %s: duplicate override %s", t.IFPrefix, o.AddressFamily)
+		}
+		overrides[o.AddressFamily] = o
+	}
+
+	var transports []Transport
+	for i, family := range t.AddressFamilies {
+		af, err := misc.ParseAF(family)
+		if err != nil || family == "" {
+			return nil, fmt.Errorf("transport %s: invalid address family %s in address_families", t.IFPrefix, family)
+		}
+		if misc.StringIn(t.AddressFamilies[:i], family) {
+			return nil, fmt.Errorf("transport %s: duplicate address family %s in address_families", t.IFPrefix, family)
+		}
+		e := t
+		e.AddressFamilies, e.Override = nil, nil
+		e.AddressFamily = af
+		e.IFPrefix = t.IFPrefix + strings.TrimPrefix(af, "ip")
+		if o, ok := overrides[family]; ok {
+			e.applyOverride(o)
+		}
+		transports = append(transports, e)
+	}
+	return transports, nil
+}
+
+// linkNames returns the names of the wireguard and vxlan links of the transport, expanded from the templates
+// in which {prefix} is replaced by ifprefix, {af} by the address family, and {family} by 4 or 6
+// the templates default to {prefix}wg and {prefix}vxlan, while go_interface takes precedence for wireguard
+func (t *Transport) linkNames() (string, string) {
+	af := misc.NewAF(t.AddressFamily)
+	replacer := strings.NewReplacer("{prefix}", t.IFPrefix, "{af}", af, "{family}", strings.TrimPrefix(af, "ip"))
+	wg, vxlan := t.WgIFName, t.VxlanIFName
+	if wg == "" {
+		wg = "{prefix}wg"
+	}
+	if vxlan == "" {
+		vxlan = "{prefix}vxlan"
+	}
+	if t.WgGoInterface != "" {
+		return t.WgGoInterface, replacer.Replace(vxlan)
+	}
+	return replacer.Replace(wg), replacer.Replace(vxlan)
+}
+
+// checkLinkNames ensures the link names of all transports are valid and do not collide
+func checkLinkNames(transports []Transport) error {
+	owners := make(map[string]int)
+	for i, t := range transports {
+		wg, vxlan := t.linkNames()
+		for _, name := range []string{wg, vxlan} {
+			if err := misc.ValidateIFName(name); err != nil {
+				return fmt.Errorf("transport %s: %s", t.IFPrefix, err)
+			}
+			if j, ok := owners[name]; ok {
+				return fmt.Errorf("transport %s: interface name %s is already used by transport %s", t.IFPrefix, name, transports[j].IFPrefix)
+			}
+			owners[name] = i
+		}
+	}
+	return nil
+}
+
+func (t *Transport) applyOverride(o TransportOverride) {
+	if o.Port != 0 {
+		t.Port = o.Port
+	}
+	if o.MTU != 0 {
+		t.MTU = o.MTU
+	}
+	if o.IFPrefix != "" {
+		t.IFPrefix = o.IFPrefix
+	}
+	if o.InnerAddress != "" {
+		t.InnerAddress = o.InnerAddress
+	}
+	if o.Mac != "" {
+		t.Mac = o.Mac
+	}
+	if o.Address != "" {
+		t.Address = o.Address
+	}
+	if o.BindAddress != "" {
+		t.BindAddress = o.BindAddress
+	}
+	if o.Keepalive != 0 {
+		t.Keepalive = o.Keepalive
 	}
-	return r, nil
 }
 
 func (r *RAIT) PublicConf(dest string) error {
-	f := hclwrite.NewEmptyFile()
+	record, err := r.PublicRecord()
+	if err != nil {
+		return err
+	}
+	w, err := misc.NewWriteCloser(dest)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	_, err = w.Write(record)
+	return err
+}
+
+// PublicRecord renders the node record published by PublicConf, one peer per public key
+func (r *RAIT) PublicRecord() ([]byte, error) {
 	pubs := Peers{}
 	pubs.Peers = make([]Peer, 0)
+	index := make(map[string]int)
 	for _, t := range r.Transport {
 		privKey, err := wgtypes.ParseKey(t.PrivateKey)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		pub := Peer{
-			PublicKey: privKey.PublicKey().String(),
-			Name:      r.Name,
-		}
-		pub.Endpoint = Endpoint{
+		endpoint := Endpoint{
 			AddressFamily: t.AddressFamily,
 			Address:       t.Address,
 			Mac:           t.Mac,
 			InnerAddress:  t.InnerAddress,
 			Port:          t.Port,
+			Keepalive:     t.Keepalive, // a node keeping its nat mapping alive asks its peers to do so as well
 		}
-		//pub.GenerateMac()
-		pubs.Peers = append(pubs.Peers, pub)
-	}
-	gohcl.EncodeIntoBody(&pubs, f.Body())
-	w, err := misc.NewWriteCloser(dest)
-	if err != nil {
-		return err
+		// transports sharing a private key are endpoints of the same peer
+		publicKey := privKey.PublicKey().String()
+		if i, ok := index[publicKey]; ok {
+			pubs.Peers[i].Endpoint = append(pubs.Peers[i].Endpoint, endpoint)
+			continue
+		}
+		index[publicKey] = len(pubs.Peers)
+		peer := Peer{
+			PublicKey: publicKey,
+			Name:      r.Name,
+			Endpoint:  []Endpoint{endpoint},
+		}
+		// the node_id is implied for the record of the key it defaults to, keeping the record as before
+		if r.NodeID != publicKey {
+			peer.NodeID = r.NodeID
+		}
+		pubs.Peers = append(pubs.Peers, peer)
 	}
-	defer w.Close()
-	_, err = w.Write(f.Bytes())
-	return err
+	// the optional attributes left unset are omitted, unlike gohcl.EncodeIntoBody
+	return misc.EncodeHCL(&pubs).Bytes(), nil
 }
@@ -23,6 +23,9 @@ func (r *RAIT) List() ([]misc.Link, error) {
 }
 
 func (r *RAIT) Load() ([]misc.Link, error) {
+	if err := checkLinkNames(r.Transport); err != nil {
+		return nil, err
+	}
 	privateKeys := make([]wgtypes.Key, 0)
 	for _, t := range r.Transport {
 		privateKey, err := wgtypes.ParseKey(t.PrivateKey)
@@ -32,7 +35,7 @@ func (r *RAIT) Load() ([]misc.Link, error) {
 		privateKeys = append(privateKeys, privateKey)
 	}
 
-	peers, err := NewPeers(r.Peers, r.CachePeers, privateKeys)
+	peers, err := r.LoadPeers(privateKeys)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load peers: %s", err)
 	}
@@ -40,7 +43,10 @@ func (r *RAIT) Load() ([]misc.Link, error) {
 	for _, t := range r.Transport {
 
 		transport := t
-		transport.AddressFamily = misc.NewAF(transport.AddressFamily)
+		transport.AddressFamily, err = misc.ParseAF(transport.AddressFamily)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transport %s: %s", transport.IFPrefix, err)
+		}
 		privKey, _ := wgtypes.ParseKey(transport.PrivateKey)
 
 		if transport.InnerAddress == "" {
@@ -66,53 +72,52 @@ func (r *RAIT) Load() ([]misc.Link, error) {
 					zap.S().Warnf("failed to parse peer public key: %s, ignoring peer", err)
 					return
 				}
-				endpoint := peer.Endpoint
-				if transport.AddressFamily != misc.NewAF(endpoint.AddressFamily) {
+				endpoint := peer.EndpointOf(transport.AddressFamily)
+				if endpoint == nil {
 					return
 				}
 				var wgEndpoint *net.UDPAddr
-				if endpoint.Address != "" {
-					zap.S().Debugf("resolv peer %s", endpoint.Address)
-					resolved, err := net.ResolveIPAddr(transport.AddressFamily, endpoint.Address)
-					if err != nil || resolved.IP == nil {
-						zap.S().Debugf("peer address %s resolve failed in address family %s", endpoint.Address, transport.AddressFamily)
-					} else {
-						zap.S().Debugf("peer address %s resolved as %s in address family %s", endpoint.Address, resolved.IP, transport.AddressFamily)
-						wgEndpoint = &net.UDPAddr{
-							IP:   resolved.IP,
-							Port: endpoint.Port,
-						}
-					}
-				}
-				peer.GenerateInnerAddress()
-				peerInnerAddress, _, err := net.ParseCIDR(peer.Endpoint.InnerAddress)
-				var allowedIPs net.IPNet
-				if peerInnerAddress.To4() == nil {
-					allowedIPs = net.IPNet{
-						IP:   peerInnerAddress,
-						Mask: net.CIDRMask(128, 128),
+				if ip := endpoint.Resolve(); ip != nil {
+					wgEndpoint = &net.UDPAddr{
+						IP:   ip,
+						Port: endpoint.Port,
 					}
 				}
+				endpoint.GenerateInnerAddress(peer.PublicKey)
+				peerInnerAddress, _, err := net.ParseCIDR(endpoint.InnerAddress)
 				if err != nil {
 					zap.S().Debugf("peer %s parse inner address failed: %s, %s, ignore peer", endpoint.Address, endpoint.InnerAddress, err)
 					return
 				}
+				// vxlan tunnels between inner addresses, which must be of the same family on both ends
+				if (peerInnerAddress.To4() == nil) != (innerIP.To4() == nil) {
+					zap.S().Warnf("peer %s inner address %s is not of the family of the local inner address %s, ignoring peer",
+						peer.PublicKey, endpoint.InnerAddress, transport.InnerAddress)
+					return
+				}
+				allowedIPs := net.IPNet{IP: peerInnerAddress, Mask: net.CIDRMask(128, 128)}
+				if ip4 := peerInnerAddress.To4(); ip4 != nil {
+					allowedIPs = net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+				}
+				psk := r.psk.For(privKey.PublicKey(), pubKey)
+				keepalive := endpoint.KeepaliveWith(transport.Keepalive)
 				mutex.Lock()
 				defer mutex.Unlock()
 				p := wgtypes.PeerConfig{
-					PublicKey:         pubKey,
-					Remove:            false,
-					UpdateOnly:        false,
-					PresharedKey:      nil,
-					Endpoint:          wgEndpoint,
-					ReplaceAllowedIPs: true,
-					AllowedIPs:        []net.IPNet{allowedIPs},
+					PublicKey:                   pubKey,
+					Remove:                      false,
+					UpdateOnly:                  false,
+					PresharedKey:                &psk,
+					PersistentKeepaliveInterval: &keepalive,
+					Endpoint:                    wgEndpoint,
+					ReplaceAllowedIPs:           true,
+					AllowedIPs:                  []net.IPNet{allowedIPs},
 				}
 				wgPeers = append(wgPeers, p)
 				n := netlink.Neigh{
 					Family:       unix.AF_BRIDGE,
 					IP:           peerInnerAddress,
-					HardwareAddr: peer.GenerateMac(),
+					HardwareAddr: endpoint.GenerateMac(peer.PublicKey),
 					Flags:        netlink.NTF_SELF,
 					State:        netlink.NUD_PERMANENT,
 				}
@@ -130,10 +135,7 @@ func (r *RAIT) Load() ([]misc.Link, error) {
 
 		wg.Wait()
 		port := transport.Port
-		linkName := transport.WgGoInterface
-		if linkName == "" {
-			linkName = transport.IFPrefix + "wg"
-		}
+		linkName, vxlanName := transport.linkNames()
 		link := misc.Link{
 			Name:          linkName,
 			Type:          "wireguard",
@@ -154,8 +156,9 @@ func (r *RAIT) Load() ([]misc.Link, error) {
 		}
 		zap.S().Debugf("local mac: %s from %s", transport.Mac, privKey.PublicKey().String()+transport.AddressFamily)
 		vxlink := misc.Link{
-			Name:    transport.IFPrefix + "vxlan",
+			Name:    vxlanName,
 			Type:    "vxlan",
+			Parent:  linkName,
 			MTU:     transport.MTU - 70,
 			Mac:     transport.Mac,
 			Address: innerIP.String(),
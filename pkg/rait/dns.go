@@ -0,0 +1,91 @@
+package rait
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Catofes/RAIT/v4/pkg/misc"
+	"go.uber.org/zap"
+)
+
+// dnsScheme is the scheme of peer sources discovered from dns, see discoverPeers
+const dnsScheme = "dns+srv"
+
+func isDNSSource(source string) bool {
+	return strings.HasPrefix(source, dnsScheme+"://")
+}
+
+// discoverPeers builds the peer list from the dns records at source, in the form of dns+srv://NAME
+// each SRV record of NAME is an endpoint, listening on the port of the record, described by the TXT records
+// at its target, consisting of key=value pairs separated by whitespace: public_key and family are mandatory,
+// while node_id, name, address, inner_address and mac are optional, address defaulting to the target itself
+// the endpoints sharing a public key make up a single peer, see mergeRecords
+// the result is rendered as a peer list in hcl, to be decoded and cached as the other sources
+func discoverPeers(source string) ([]byte, error) {
+	parsed, err := url.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns source %s: %s", source, err)
+	}
+	name := parsed.Host
+	if name == "" {
+		return nil, fmt.Errorf("invalid dns source %s: missing name", source)
+	}
+
+	resolver := misc.DefaultResolver
+	ctx, cancel := resolver.Context()
+	defer cancel()
+	_, records, err := resolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up SRV records of %s: %s", name, err)
+	}
+
+	peers := &Peers{}
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		txts, err := resolver.LookupTXT(ctx, target)
+		if err != nil {
+			zap.S().Warnf("ignoring SRV target %s of %s: failed to look up TXT records: %s", target, name, err)
+			continue
+		}
+		attrs := make(map[string]string)
+		for _, txt := range txts {
+			for _, field := range strings.Fields(txt) {
+				if kv := strings.SplitN(field, "=", 2); len(kv) == 2 {
+					attrs[kv[0]] = kv[1]
+				}
+			}
+		}
+		if attrs["public_key"] == "" || attrs["family"] == "" {
+			zap.S().Warnf("ignoring SRV target %s of %s: public_key or family missing in TXT records", target, name)
+			continue
+		}
+		// a typo must not silently turn into the default family
+		af, err := misc.ParseAF(attrs["family"])
+		if err != nil {
+			zap.S().Warnf("ignoring SRV target %s of %s: %s", target, name, err)
+			continue
+		}
+		address := attrs["address"]
+		if address == "" {
+			address = target
+		}
+		peers.Peers = append(peers.Peers, Peer{
+			PublicKey: attrs["public_key"],
+			NodeID:    attrs["node_id"],
+			Name:      attrs["name"],
+			Endpoint: []Endpoint{{
+				AddressFamily: af,
+				Port:          int(record.Port),
+				Address:       address,
+				InnerAddress:  attrs["inner_address"],
+				Mac:           attrs["mac"],
+			}},
+		})
+	}
+	if len(peers.Peers) == 0 {
+		return nil, fmt.Errorf("no peer discovered from %s", name)
+	}
+	peers.Peers = mergeRecords(peers.Peers)
+	return misc.EncodeHCL(peers).Bytes(), nil
+}
@@ -0,0 +1,103 @@
+package rait
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	"github.com/zclconf/go-cty/cty/gocty"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// PeerFilter selects the peers to connect to, a peer matching any deny rule is dropped,
+// then if any allow rule is set, only the peers matching at least one of them are kept
+type PeerFilter struct {
+	AllowKeys  []string `hcl:"allow_keys,optional"`  // optional, public keys of the peers to keep
+	DenyKeys   []string `hcl:"deny_keys,optional"`   // optional, public keys of the peers to drop
+	AllowNames []string `hcl:"allow_names,optional"` // optional, glob patterns of the names of the peers to keep
+	DenyNames  []string `hcl:"deny_names,optional"`  // optional, glob patterns of the names of the peers to drop
+	AllowTags  []string `hcl:"allow_tags,optional"`  // optional, tags of the peers to keep, see Peer.Tags
+	DenyTags   []string `hcl:"deny_tags,optional"`   // optional, tags of the peers to drop, see Peer.Tags
+}
+
+// validate checks the keys and patterns of the filter, a nil filter is valid
+func (f *PeerFilter) validate() error {
+	if f == nil {
+		return nil
+	}
+	for _, key := range append(append([]string{}, f.AllowKeys...), f.DenyKeys...) {
+		if _, err := wgtypes.ParseKey(key); err != nil {
+			return fmt.Errorf("peer_filter: invalid public key %s: %s", key, err)
+		}
+	}
+	for _, pattern := range append(append([]string{}, f.AllowNames...), f.DenyNames...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("peer_filter: invalid name pattern %s: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Match tells whether the peer passes the filter, with the rule deciding it for logging, a nil filter passes every peer
+func (f *PeerFilter) Match(peer *Peer) (bool, string) {
+	if f == nil {
+		return true, ""
+	}
+	tags := peer.Tags()
+	if rule, ok := f.matchAny(peer, tags, f.DenyKeys, f.DenyNames, f.DenyTags); ok {
+		return false, "denied by " + rule
+	}
+	if len(f.AllowKeys) == 0 && len(f.AllowNames) == 0 && len(f.AllowTags) == 0 {
+		return true, ""
+	}
+	if rule, ok := f.matchAny(peer, tags, f.AllowKeys, f.AllowNames, f.AllowTags); ok {
+		return true, "allowed by " + rule
+	}
+	return false, "not allowed by any rule"
+}
+
+func (f *PeerFilter) matchAny(peer *Peer, tags, keys, names, wanted []string) (string, bool) {
+	for _, key := range keys {
+		if peer.PublicKey == key {
+			return "key " + key, true
+		}
+	}
+	for _, pattern := range names {
+		if matched, _ := filepath.Match(pattern, peer.Name); matched && peer.Name != "" {
+			return "name " + pattern, true
+		}
+	}
+	for _, tag := range wanted {
+		for _, t := range tags {
+			if t == tag {
+				return "tag " + tag, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Tags returns the tags attribute in the remarks of the peer, either a string or a list of strings
+func (s *Peer) Tags() []string {
+	remarks, err := s.RemarksValue()
+	if err != nil {
+		return nil
+	}
+	value, ok, err := QueryValue(remarks, "tags")
+	if err != nil || !ok || value.IsNull() || !value.IsWhollyKnown() {
+		return nil
+	}
+	if value.Type() == cty.String {
+		return []string{value.AsString()}
+	}
+	value, err = convert.Convert(value, cty.List(cty.String))
+	if err != nil {
+		return nil
+	}
+	var tags []string
+	if err := gocty.FromCtyValue(value, &tags); err != nil {
+		return nil
+	}
+	return tags
+}
@@ -0,0 +1,93 @@
+package rait
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// PeerInfo is what rait derives from a peer record, for inspection
+type PeerInfo struct {
+	Name      string         `json:"name"`
+	Node      string         `json:"node"` // node_id of the peer, its public key unless set
+	PublicKey string         `json:"public_key"`
+	RouteID   string         `json:"route_id"`
+	Self      bool           `json:"self"`             // the peer is the node itself, thus not connected to
+	Status    string         `json:"status"`           // whether the peer is connected to, see PeerState
+	Reason    string         `json:"reason,omitempty"` // why the peer is not connected to
+	Endpoints []EndpointInfo `json:"endpoints"`
+}
+
+// EndpointInfo is what rait derives from an endpoint record, for inspection
+type EndpointInfo struct {
+	AddressFamily string `json:"address_family"`
+	Port          int    `json:"port"`
+	Address       string `json:"address,omitempty"`
+	ResolvedIP    string `json:"resolved_ip,omitempty"` // empty if the address is empty or unresolvable
+	Mac           string `json:"mac"`
+	InnerAddress  string `json:"inner_address"`
+}
+
+// InspectPeers loads the peers as in Load, with those rait does not connect to, e.g. the node itself
+// and the revoked or filtered peers, included but marked as such, see PeerState,
+// and derives the addresses rait would use for each of them
+// the peers of a node are listed together, the nodes in the order they first appear
+func (r *RAIT) InspectPeers() ([]PeerInfo, error) {
+	var privateKeys []wgtypes.Key
+	for _, t := range r.Transport {
+		if privateKey, err := wgtypes.ParseKey(t.PrivateKey); err == nil {
+			privateKeys = append(privateKeys, privateKey)
+		}
+	}
+	states, err := r.LoadPeerStates(privateKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]PeerInfo, 0, len(states))
+	for _, state := range states {
+		peer := state.Peer
+		info := PeerInfo{
+			Name:      peer.Name,
+			Node:      peer.Node(),
+			PublicKey: peer.PublicKey,
+			RouteID:   peer.RouteID(),
+			Self:      state.Status == PeerSelf,
+			Status:    state.Status,
+			Reason:    state.Reason,
+			Endpoints: make([]EndpointInfo, 0, len(peer.Endpoint)),
+		}
+		for i := range peer.Endpoint {
+			endpoint := &peer.Endpoint[i]
+			e := EndpointInfo{
+				AddressFamily: endpoint.AddressFamily,
+				Port:          endpoint.Port,
+				Address:       endpoint.Address,
+				Mac:           endpoint.GenerateMac(peer.PublicKey).String(),
+			}
+			endpoint.GenerateInnerAddress(peer.PublicKey)
+			e.InnerAddress = endpoint.InnerAddress
+			if ip := endpoint.Resolve(); ip != nil {
+				e.ResolvedIP = ip.String()
+			}
+			info.Endpoints = append(info.Endpoints, e)
+		}
+		infos = append(infos, info)
+	}
+	return groupByNode(infos), nil
+}
+
+// groupByNode reorders infos so that the peers sharing a node are adjacent, keeping their order otherwise
+func groupByNode(infos []PeerInfo) []PeerInfo {
+	var nodes []string
+	groups := make(map[string][]PeerInfo)
+	for _, info := range infos {
+		if _, ok := groups[info.Node]; !ok {
+			nodes = append(nodes, info.Node)
+		}
+		groups[info.Node] = append(groups[info.Node], info)
+	}
+	grouped := make([]PeerInfo, 0, len(infos))
+	for _, node := range nodes {
+		grouped = append(grouped, groups[node]...)
+	}
+	return grouped
+}
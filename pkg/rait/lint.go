@@ -0,0 +1,159 @@
+package rait
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Catofes/RAIT/v4/pkg/misc"
+	"github.com/hashicorp/hcl/v2"
+)
+
+// peerRecord is a peer record with where it is defined, for reporting
+type peerRecord struct {
+	Peer
+	where string
+}
+
+func (r peerRecord) String() string {
+	name := r.Name
+	if name == "" {
+		name = "-"
+	}
+	return fmt.Sprintf("%s (%s) at %s", name, r.PublicKey, r.where)
+}
+
+// collisions reports the problems among peer records that break the mesh silently:
+// a public key listed more than once in the same address family, different peers sharing a mac address
+// or an inner address in the same address family, which vxlan forwarding relies on, and different nodes sharing a name, see Peer.Node
+// the derived mac and inner addresses are taken into account, see Endpoint.GenerateMac and Endpoint.GenerateInnerAddress
+func collisions(records []peerRecord) []string {
+	keys := newCollisionSet()
+	macs := newCollisionSet()
+	inners := newCollisionSet()
+	names := newCollisionSet()
+	for i, record := range records {
+		if record.Name != "" {
+			// the records of a single node share its name
+			names.add(record.Name, i, record.Node())
+		}
+		for _, endpoint := range record.Endpoint {
+			af, err := misc.ParseAF(endpoint.AddressFamily)
+			if err != nil {
+				// reported by Peers.Validate
+				continue
+			}
+			// the record itself is not touched, as the addresses left unset are derived on the copy
+			e := endpoint
+			keys.add(af+" "+record.PublicKey, i, fmt.Sprint(i))
+			macs.add(af+" "+e.GenerateMac(record.PublicKey).String(), i, record.PublicKey)
+			if ip := e.GenerateInnerAddress(record.PublicKey); ip != nil {
+				inners.add(af+" "+ip.String(), i, record.PublicKey)
+			}
+		}
+	}
+
+	var problems []string
+	report := func(set *collisionSet, format string) {
+		for _, value := range set.order {
+			if len(set.owners[value]) < 2 {
+				continue
+			}
+			var entries []string
+			for _, i := range set.records[value] {
+				entries = append(entries, records[i].String())
+			}
+			af := strings.SplitN(value, " ", 2)
+			problems = append(problems, fmt.Sprintf(format, af[len(af)-1], af[0])+": "+strings.Join(entries, ", "))
+		}
+	}
+	report(keys, "public key %s is listed more than once in %s")
+	report(macs, "mac address %s is shared in %s")
+	report(inners, "inner address %s is shared in %s")
+	for _, name := range names.order {
+		if len(names.owners[name]) < 2 {
+			continue
+		}
+		var entries []string
+		for _, i := range names.records[name] {
+			entries = append(entries, records[i].String())
+		}
+		problems = append(problems, fmt.Sprintf("name %s is shared by different nodes: %s", name, strings.Join(entries, ", ")))
+	}
+	return problems
+}
+
+// overrideRecords appends the records of source to records, replacing those of the same public keys
+// the records left are those the peers are made up of, see NewPeers
+func overrideRecords(records []peerRecord, source string, peers []Peer) []peerRecord {
+	keys := make(map[string]bool)
+	for _, peer := range peers {
+		keys[peer.PublicKey] = true
+	}
+	n := 0
+	for _, record := range records {
+		if !keys[record.PublicKey] {
+			records[n] = record
+			n++
+		}
+	}
+	records = records[:n]
+	for i, peer := range peers {
+		records = append(records, peerRecord{Peer: peer, where: fmt.Sprintf("%s peers[%d]", source, i)})
+	}
+	return records
+}
+
+// collisionSet groups records by a value, counting the distinct owners of each value
+type collisionSet struct {
+	order   []string
+	records map[string][]int
+	owners  map[string]map[string]bool
+}
+
+func newCollisionSet() *collisionSet {
+	return &collisionSet{records: make(map[string][]int), owners: make(map[string]map[string]bool)}
+}
+
+func (s *collisionSet) add(value string, record int, owner string) {
+	if _, ok := s.owners[value]; !ok {
+		s.order = append(s.order, value)
+		s.owners[value] = make(map[string]bool)
+	}
+	if len(s.records[value]) == 0 || s.records[value][len(s.records[value])-1] != record {
+		s.records[value] = append(s.records[value], record)
+	}
+	s.owners[value][owner] = true
+}
+
+// LintPeers checks the peer lists at paths as a whole, as published by a registry, see Peers.Validate and collisions
+// the problems are returned as diagnostics, the collisions carrying no source range but the locations of the offending entries
+func LintPeers(paths []string) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	var records []peerRecord
+	for _, path := range paths {
+		data, err := misc.ReadAll(path)
+		if err != nil {
+			diags = append(diags, readFailure(err))
+			continue
+		}
+		p := &Peers{}
+		file, decodeDiags := misc.DecodeHCL(path, data, p)
+		diags = append(diags, decodeDiags...)
+		if decodeDiags.HasErrors() {
+			continue
+		}
+		diags = append(diags, p.Validate(file.Body)...)
+		root := newLocator(file.Body)
+		for i, peer := range p.Peers {
+			rng := root.block("peers", i).rng
+			records = append(records, peerRecord{Peer: peer, where: fmt.Sprintf("%s:%d", rng.Filename, rng.Start.Line)})
+		}
+	}
+	for _, problem := range collisions(records) {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  problem,
+		})
+	}
+	return diags
+}
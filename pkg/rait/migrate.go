@@ -0,0 +1,141 @@
+package rait
+
+import (
+	"fmt"
+
+	"github.com/Catofes/RAIT/v4/pkg/misc"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// legacyRAIT is the model of rait.conf in the toml era, where a node had a single transport
+// SendPort was the destination port of every packet the node sends, i.e. each peer listened on it for this node,
+// while the port in current schema is the one the node listens on for all of its peers, where the others send to
+// mapping SendPort to port thus holds for a mesh as a whole, each node keeping its unique port, but not for a single node
+type legacyRAIT struct {
+	PrivateKey         string
+	Name               string
+	Peers              string
+	AddressFamily      string
+	SendPort           int
+	MTU                int
+	IFPrefix           string
+	IFGroup            int
+	FwMark             int
+	TransitNamespace   string
+	InterfaceNamespace string
+}
+
+// legacyPeers is the model of peers.conf in the toml era, with one [[Peers]] table per peer
+type legacyPeers struct {
+	Peers []legacyPeer
+}
+
+type legacyPeer struct {
+	PublicKey     string
+	Name          string
+	AddressFamily string
+	SendPort      int
+	Endpoint      string
+}
+
+// MigrateConf converts the toml rait.conf read from src into the current hcl schema
+// the fields that can not be translated are reported as warnings alongside the result
+func MigrateConf(src string) ([]byte, []string, error) {
+	var legacy legacyRAIT
+	undecoded, err := misc.UnmarshalTOML(src, &legacy)
+	if err != nil {
+		return nil, nil, err
+	}
+	warnings := untranslated(undecoded)
+	af, warning := migrateAF(legacy.AddressFamily, "AddressFamily")
+	if warning != "" {
+		warnings = append(warnings, warning)
+	}
+
+	r := &RAIT{
+		Name:  legacy.Name,
+		Peers: cty.StringVal(legacy.Peers),
+		Transport: []Transport{{
+			PrivateKey:    legacy.PrivateKey,
+			AddressFamily: af,
+			Port:          legacy.SendPort,
+			MTU:           legacy.MTU,
+			IFPrefix:      legacy.IFPrefix,
+			FwMark:        legacy.FwMark,
+		}},
+	}
+	if legacy.IFGroup != 0 || legacy.TransitNamespace != "" || legacy.InterfaceNamespace != "" {
+		r.Isolation = &Isolation{
+			IFGroup: legacy.IFGroup,
+			Transit: legacy.TransitNamespace,
+			Target:  legacy.InterfaceNamespace,
+		}
+	}
+	for _, mandatory := range []struct {
+		field   string
+		missing bool
+	}{
+		{"PrivateKey", legacy.PrivateKey == ""},
+		{"Peers", legacy.Peers == ""},
+		{"SendPort", legacy.SendPort == 0},
+		{"MTU", legacy.MTU == 0},
+		{"IFPrefix", legacy.IFPrefix == ""},
+	} {
+		if mandatory.missing {
+			warnings = append(warnings, fmt.Sprintf("mandatory field %s is missing, fill in the result before use", mandatory.field))
+		}
+	}
+	return misc.EncodeHCL(r).Bytes(), warnings, nil
+}
+
+// MigratePeers converts the toml peers.conf read from src into the current hcl schema
+// the fields that can not be translated are reported as warnings alongside the result
+func MigratePeers(src string) ([]byte, []string, error) {
+	var legacy legacyPeers
+	undecoded, err := misc.UnmarshalTOML(src, &legacy)
+	if err != nil {
+		return nil, nil, err
+	}
+	warnings := untranslated(undecoded)
+
+	peers := &Peers{}
+	for i, l := range legacy.Peers {
+		if l.PublicKey == "" || l.SendPort == 0 {
+			warnings = append(warnings, fmt.Sprintf("peer #%d lacks PublicKey or SendPort, fill in the result before use", i+1))
+		}
+		af, warning := migrateAF(l.AddressFamily, fmt.Sprintf("AddressFamily of peer #%d", i+1))
+		if warning != "" {
+			warnings = append(warnings, warning)
+		}
+		peers.Peers = append(peers.Peers, Peer{
+			PublicKey: l.PublicKey,
+			Name:      l.Name,
+			Endpoint: []Endpoint{{
+				AddressFamily: af,
+				Port:          l.SendPort,
+				Address:       l.Endpoint,
+			}},
+		})
+	}
+	// a peer listed once per address family becomes a single peer with several endpoints
+	peers.Peers = mergeRecords(peers.Peers)
+	return misc.EncodeHCL(peers).Bytes(), warnings, nil
+}
+
+// migrateAF translates a legacy address family, which defaulted to ip4 as it does now
+// an unrecognized value is kept as is with a warning, rather than silently changing the meaning of the result
+func migrateAF(af, field string) (string, string) {
+	parsed, err := misc.ParseAF(af)
+	if err != nil {
+		return af, fmt.Sprintf("field %s: %s, not translated, fix the result before use", field, err)
+	}
+	return parsed, ""
+}
+
+func untranslated(keys []string) []string {
+	var warnings []string
+	for _, key := range keys {
+		warnings = append(warnings, fmt.Sprintf("field %s has no equivalent in current schema, not translated", key))
+	}
+	return warnings
+}
@@ -1,7 +1,11 @@
 package rait
 
 import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
 	"net"
+	"time"
 
 	"github.com/Catofes/RAIT/v4/pkg/misc"
 	"github.com/hashicorp/hcl/v2"
@@ -10,69 +14,349 @@ import (
 )
 
 type Peers struct {
-	Peers []Peer `hcl:"peers,block"`
+	Revoked []string `hcl:"revoked,optional"` // optional, public keys refused whichever source lists them
+	Peers   []Peer   `hcl:"peers,block"`
+}
+
+// SetEvalContext keeps the evaluation context in every peer for querying remarks
+func (p *Peers) SetEvalContext(ctx *hcl.EvalContext) {
+	for i := range p.Peers {
+		p.Peers[i].evalContext = ctx
+	}
 }
 
 type Peer struct {
-	PublicKey string   `hcl:"public_key,attr"` // mandatory, wireguard public key, base64 encoded
-	Name      string   `hcl:"name,optional"`   // optional, peer human readable name
-	Remarks   hcl.Body `hcl:"remarks,remain"`  // optional, additional information
-	Endpoint  Endpoint `hcl:"endpoint,block"`  // mandatory, node endpoints
+	PublicKey string     `hcl:"public_key,attr"`     // mandatory, wireguard public key, base64 encoded
+	NodeID    string     `hcl:"node_id,optional"`    // optional, identity of the node the peer belongs to, tying its records together, see Node
+	Name      string     `hcl:"name,optional"`       // optional, peer human readable name
+	NotBefore string     `hcl:"not_before,optional"` // optional, RFC 3339 time before which the peer is ignored
+	NotAfter  string     `hcl:"not_after,optional"`  // optional, RFC 3339 time after which the peer is ignored
+	Remarks   hcl.Body   `hcl:"remarks,remain"`      // optional, additional information
+	Endpoint  []Endpoint `hcl:"endpoint,block"`      // mandatory, node endpoints, at most one per address family
+
+	evalContext *hcl.EvalContext
+}
+
+// EndpointOf returns the endpoint of the peer in the given address family, nil if there is none
+func (s *Peer) EndpointOf(af string) *Endpoint {
+	for i := range s.Endpoint {
+		if misc.NewAF(s.Endpoint[i].AddressFamily) == af {
+			return &s.Endpoint[i]
+		}
+	}
+	return nil
+}
+
+// Node returns the identity of the node the peer belongs to, its public key unless node_id is set
+func (s *Peer) Node() string {
+	if s.NodeID != "" {
+		return s.NodeID
+	}
+	return s.PublicKey
+}
+
+// RouteID returns the router id of the peer in babeld, derived from its node, see RouterID
+func (s *Peer) RouteID() string {
+	return RouterID(s.Node())
+}
+
+// RouterID derives the babeld router id of a node from its identity, see RAIT.RouterID and Peer.Node
+func RouterID(node string) string {
+	hash := md5.Sum([]byte(node + "\n"))
+	id := hex.EncodeToString(hash[:])
+	return fmt.Sprintf("%s:%s:%s:%s:%s:%s:%s:%s",
+		id[0:2], id[2:4], id[4:6], id[6:8], id[8:10], id[10:12], id[12:14], id[14:16])
+}
+
+// validity parses the validity window of the peer, the zero time standing for an open bound
+func (s *Peer) validity() (notBefore, notAfter time.Time, err error) {
+	if s.NotBefore != "" {
+		if notBefore, err = time.Parse(time.RFC3339, s.NotBefore); err != nil {
+			return notBefore, notAfter, fmt.Errorf("invalid not_before: %s", err)
+		}
+	}
+	if s.NotAfter != "" {
+		if notAfter, err = time.Parse(time.RFC3339, s.NotAfter); err != nil {
+			return notBefore, notAfter, fmt.Errorf("invalid not_after: %s", err)
+		}
+	}
+	if !notBefore.IsZero() && !notAfter.IsZero() && !notBefore.Before(notAfter) {
+		return notBefore, notAfter, fmt.Errorf("not_before %s is not before not_after %s", s.NotBefore, s.NotAfter)
+	}
+	return notBefore, notAfter, nil
+}
+
+// Active reports whether the peer is within its validity window at now, with the reason if not
+// a peer with an invalid window is never active
+func (s *Peer) Active(now time.Time) (bool, string) {
+	notBefore, notAfter, err := s.validity()
+	switch {
+	case err != nil:
+		return false, err.Error()
+	case !notBefore.IsZero() && now.Before(notBefore):
+		return false, fmt.Sprintf("not valid before %s", s.NotBefore)
+	case !notAfter.IsZero() && !now.Before(notAfter):
+		return false, fmt.Sprintf("expired at %s", s.NotAfter)
+	}
+	return true, ""
+}
+
+// merge adds the endpoints of another record of the same peer, replacing those in the same address family
+func (s *Peer) merge(other Peer) {
+	for _, endpoint := range other.Endpoint {
+		if existing := s.EndpointOf(misc.NewAF(endpoint.AddressFamily)); existing != nil {
+			*existing = endpoint
+		} else {
+			s.Endpoint = append(s.Endpoint, endpoint)
+		}
+	}
+}
+
+type Endpoint struct {
+	AddressFamily string `hcl:"address_family,attr" json:"address_family"`             // mandatory, socket address family, ip4 or ip6
+	Mac           string `hcl:"mac,optional" json:"mac,omitempty"`                     // optional, mac address
+	Port          int    `hcl:"port,attr" json:"port"`                                 // mandatory, socket listen port
+	InnerAddress  string `hcl:"inner_address,optional" json:"inner_address,omitempty"` // optional, remote inner address
+	Address       string `hcl:"address,optional" json:"address,omitempty"`             // optional, ip address or resolvable domain name
+	Keepalive     int    `hcl:"keepalive,optional" json:"keepalive,omitempty"`         // optional, persistent keepalive interval in seconds the peers should use, e.g. behind nat
 }
 
-func (s *Peer) GenerateMac() net.HardwareAddr {
-	if s.Endpoint.Mac != "" {
-		if mac, err := net.ParseMAC(s.Endpoint.Mac); err == nil {
+// KeepaliveWith returns the persistent keepalive interval to use towards the endpoint from a transport configured with local,
+// the shorter of both if set, zero for none
+func (e *Endpoint) KeepaliveWith(local int) time.Duration {
+	interval := local
+	if e.Keepalive > 0 && (interval <= 0 || e.Keepalive < interval) {
+		interval = e.Keepalive
+	}
+	if interval < 0 {
+		interval = 0
+	}
+	return time.Duration(interval) * time.Second
+}
+
+// Resolve resolves the address of the endpoint in its address family, nil if the address is empty or unresolvable
+func (e *Endpoint) Resolve() net.IP {
+	if e.Address == "" {
+		return nil
+	}
+	af := misc.NewAF(e.AddressFamily)
+	zap.S().Debugf("resolv peer %s", e.Address)
+	resolved, err := net.ResolveIPAddr(af, e.Address)
+	if err != nil || resolved.IP == nil {
+		zap.S().Debugf("peer address %s resolve failed in address family %s", e.Address, af)
+		return nil
+	}
+	zap.S().Debugf("peer address %s resolved as %s in address family %s", e.Address, resolved.IP, af)
+	return resolved.IP
+}
+
+// GenerateMac returns the mac address of the endpoint, derived from the public key of its peer if not set
+func (e *Endpoint) GenerateMac(publicKey string) net.HardwareAddr {
+	if e.Mac != "" {
+		if mac, err := net.ParseMAC(e.Mac); err == nil {
 			return mac
 		}
 	}
-	mac := misc.NewMacFromKey(s.PublicKey + s.Endpoint.AddressFamily)
-	s.Endpoint.Mac = mac.String()
-	zap.S().Debugf("peer mac: %s from %s", mac, s.PublicKey+s.Endpoint.AddressFamily)
+	mac := misc.NewMacFromKey(publicKey + e.AddressFamily)
+	e.Mac = mac.String()
+	zap.S().Debugf("peer mac: %s from %s", mac, publicKey+e.AddressFamily)
 	return mac
 }
 
-func (s *Peer) GenerateInnerAddress() net.IP {
-	if s.Endpoint.InnerAddress == "" {
-		s.Endpoint.InnerAddress = misc.NewLLAddrFromKey(s.PublicKey + s.Endpoint.AddressFamily + "wireguard").String()
+// GenerateInnerAddress returns the inner address of the endpoint, derived from the public key of its peer if not set
+func (e *Endpoint) GenerateInnerAddress(publicKey string) net.IP {
+	if e.InnerAddress == "" {
+		e.InnerAddress = misc.NewLLAddrFromKey(publicKey + e.AddressFamily + "wireguard").String()
 	}
-	return net.ParseIP(s.Endpoint.InnerAddress)
+	if ip, _, err := net.ParseCIDR(e.InnerAddress); err == nil {
+		return ip
+	}
+	return net.ParseIP(e.InnerAddress)
 }
 
-type Endpoint struct {
-	AddressFamily string `hcl:"address_family,attr"`    // mandatory, socket address family, ip4 or ip6
-	Mac           string `hcl:"mac,optional"`           // optional, mac address
-	Port          int    `hcl:"port,attr"`              // mandatory, socket listen port
-	InnerAddress  string `hcl:"inner_address,optional"` // optional, remote inner address
-	Address       string `hcl:"address,optional"`       // optional, ip address or resolvable domain name
+// the statuses of a peer, see PeerState
+const (
+	PeerActive   = "active"   // the peer is connected to
+	PeerSelf     = "self"     // the peer is the node itself
+	PeerRevoked  = "revoked"  // the public key of the peer is revoked by a source
+	PeerInactive = "inactive" // the peer is outside of its validity window
+	PeerFiltered = "filtered" // the peer does not pass peer_filter
+)
+
+// PeerState is a peer along with whether it is connected to, and why not
+type PeerState struct {
+	Peer
+	Status string // one of the Peer* statuses
+	Reason string // details of the status, empty if active or self
 }
 
-func NewPeers(path, cachePath string, privateKeys []wgtypes.Key) ([]Peer, error) {
-	var peersTmp = &Peers{}
-	if err := misc.LoadPeers(path, cachePath, peersTmp); err != nil {
+// NewPeers loads the peer lists from sources, see misc.LoadPeers, and merges them in order
+// a peer is identified by its public key, a record from a later source replaces the one
+// from earlier sources in place, so that e.g. a local file listed last overrides the registries
+// a source failing to load is skipped with a warning, keeping the peers from the other sources,
+// it is an error only if every source fails
+// the lists fetched over http are verified by verifier if not nil, see misc.LoadPeers
+// the peers owning any of privateKeys, which is the node itself, and those not passing filter are filtered out
+// node_id only groups the peers, e.g. for their router ids, it is not authenticated thus never overrides nor filters them, see Peer.Node
+func NewPeers(sources []string, cache misc.Cache, verifier *misc.Verifier, filter *PeerFilter, privateKeys []wgtypes.Key) ([]Peer, error) {
+	states, err := NewPeerStates(sources, cache, verifier, filter, privateKeys)
+	if err != nil {
 		return nil, err
 	}
-	peers := peersTmp.Peers
-
-	// in place filter to remove self from peers
-	n := 0
-	if privateKeys != nil {
-		for _, peer := range peers {
-			for _, privateKey := range privateKeys {
-				if peer.PublicKey != privateKey.PublicKey().String() {
-					peer.GenerateMac()
-					peers[n] = peer
-					n++
-					break
-				}
+	return activePeers(states), nil
+}
+
+// activePeers picks the active peers out of states, logging why the others are skipped
+func activePeers(states []PeerState) []Peer {
+	peers := make([]Peer, 0, len(states))
+	for _, state := range states {
+		peer := state.Peer
+		switch state.Status {
+		case PeerSelf:
+			continue
+		case PeerRevoked, PeerInactive:
+			zap.S().Infof("peer %s %s ignored: %s", peer.Name, peer.PublicKey, state.Reason)
+			continue
+		case PeerFiltered:
+			zap.S().Debugf("peer %s %s filtered out: %s", peer.Name, peer.PublicKey, state.Reason)
+			continue
+		}
+		for i := range peer.Endpoint {
+			peer.Endpoint[i].GenerateMac(peer.PublicKey)
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// NewPeerStates loads and merges the peers as in NewPeers, but keeps every peer, each with its status
+func NewPeerStates(sources []string, cache misc.Cache, verifier *misc.Verifier, filter *PeerFilter, privateKeys []wgtypes.Key) ([]PeerState, error) {
+	var peers []Peer
+	var records []peerRecord
+	index := make(map[string]int)
+	// revocations are collected from every source, so that a key revoked by any of them is refused
+	// even if another source, or a stale cache of it, still lists the key
+	revoked := make(map[string]string)
+	loaded := 0
+	for _, source := range sources {
+		var peersTmp = &Peers{}
+		if err := loadSource(source, cache.For(source, len(sources)), verifier, peersTmp); err != nil {
+			zap.S().Warnf("skipping peer source %s: %s", source, err)
+			continue
+		}
+		loaded++
+		for _, key := range peersTmp.Revoked {
+			if _, ok := revoked[key]; !ok {
+				revoked[key] = source
 			}
 		}
-	} else {
-		for _, peer := range peers {
-			peer.GenerateMac()
-			peers[n] = peer
-			n++
+		records = overrideRecords(records, source, peersTmp.Peers)
+		for _, peer := range mergeRecords(peersTmp.Peers) {
+			if i, ok := index[peer.PublicKey]; ok {
+				zap.S().Debugf("peer %s from %s overrides the previous record", peer.PublicKey, source)
+				peers[i] = peer
+				continue
+			}
+			index[peer.PublicKey] = len(peers)
+			peers = append(peers, peer)
+		}
+	}
+	if loaded == 0 {
+		return nil, fmt.Errorf("failed to load peers from any of %d source(s)", len(sources))
+	}
+	for _, problem := range collisions(records) {
+		zap.S().Warn(problem)
+	}
+
+	self := make(map[string]bool)
+	for _, privateKey := range privateKeys {
+		self[privateKey.PublicKey().String()] = true
+	}
+	for key := range self {
+		if source, ok := revoked[key]; ok {
+			zap.S().Warnf("the public key %s of this node is revoked by %s", key, source)
+		}
+	}
+	now := time.Now()
+	states := make([]PeerState, 0, len(peers))
+	for _, peer := range peers {
+		state := PeerState{Peer: peer, Status: PeerActive}
+		if source, ok := revoked[peer.PublicKey]; ok {
+			state.Status, state.Reason = PeerRevoked, "revoked by "+source
+		} else if ok, reason := peer.Active(now); !ok {
+			state.Status, state.Reason = PeerInactive, reason
+		} else if ok, reason := filter.Match(&peer); !ok {
+			state.Status, state.Reason = PeerFiltered, reason
+		}
+		// the node itself is never connected to, whatever the other statuses
+		if self[peer.PublicKey] {
+			state.Status, state.Reason = PeerSelf, ""
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// loadSource loads a single peer list, discovered from dns, see discoverPeers, or read from a file or url, see misc.LoadPeers
+func loadSource(source string, cache misc.Cache, verifier *misc.Verifier, p *Peers) error {
+	if !isDNSSource(source) {
+		return misc.LoadPeers(source, cache, verifier, p)
+	}
+	if verifier != nil {
+		return fmt.Errorf("peer lists discovered from dns can not be signed, refused as peer_signature is set")
+	}
+	data := misc.LoadWithCache(source, cache, func() ([]byte, error) {
+		return discoverPeers(source)
+	})
+	if data == nil {
+		return fmt.Errorf("failed to discover peers from %s and cache", source)
+	}
+	if _, diags := misc.DecodeHCL(source, data, p); diags.HasErrors() {
+		return fmt.Errorf("failed to decode hcl: %w", diags)
+	}
+	return nil
+}
+
+// LoadPeers loads the peers from the sources configured in rait.conf, see NewPeers,
+// privateKeys are those of the node itself, which may be nil to keep every peer
+func (r *RAIT) LoadPeers(privateKeys []wgtypes.Key) ([]Peer, error) {
+	states, err := r.LoadPeerStates(privateKeys)
+	if err != nil {
+		return nil, err
+	}
+	return activePeers(states), nil
+}
+
+// LoadPeerStates loads every peer from the sources configured in rait.conf with its status, see NewPeerStates,
+// privateKeys are those of the node itself, which may be nil
+func (r *RAIT) LoadPeerStates(privateKeys []wgtypes.Key) ([]PeerState, error) {
+	sources, err := r.PeerSources()
+	if err != nil {
+		return nil, err
+	}
+	cache, err := r.PeerCache()
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := r.Verifier()
+	if err != nil {
+		return nil, err
+	}
+	return NewPeerStates(sources, cache, verifier, r.Filter, privateKeys)
+}
+
+// mergeRecords merges the records sharing a public key in a single peer list, as in the layout where
+// a peer is listed once per endpoint, the name and remarks are taken from the first record
+func mergeRecords(records []Peer) []Peer {
+	var peers []Peer
+	index := make(map[string]int)
+	for _, record := range records {
+		if i, ok := index[record.PublicKey]; ok && record.PublicKey != "" {
+			peers[i].merge(record)
+			continue
 		}
+		index[record.PublicKey] = len(peers)
+		peers = append(peers, record)
 	}
-	return peers[:n], nil
+	return peers
 }
@@ -0,0 +1,107 @@
+package rait
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/Catofes/RAIT/v4/pkg/misc"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// pskMinSecretLen is the minimal length of the mesh secret, in bytes
+const pskMinSecretLen = 16
+
+// PresharedKey configures the wireguard preshared keys, for post-quantum hardening of the handshakes
+// the preshared key of a pair of nodes is derived from a mesh wide secret and both public keys, so both of them
+// compute the same value without exchanging anything, while explicit preshared keys take precedence for the peers listed
+type PresharedKey struct {
+	Secret           string `hcl:"secret,optional"`            // optional, mesh wide secret, shared by every node but never published
+	SecretFile       string `hcl:"secret_file,optional"`       // optional, file to load the secret from
+	SecretEnv        string `hcl:"secret_env,optional"`        // optional, environment variable to load the secret from
+	SecretCredential string `hcl:"secret_credential,optional"` // optional, systemd credential to load the secret from
+	KeysFile         string `hcl:"keys_file,optional"`         // optional, file of explicit preshared keys, one "PUBLIC_KEY PRESHARED_KEY" per line
+}
+
+// presharedKeys is the resolved form of PresharedKey
+type presharedKeys struct {
+	secret   []byte
+	explicit map[string]wgtypes.Key // by public key of the peer
+}
+
+// load resolves the secret and reads the explicit keys, nil is returned if p is nil
+func (p *PresharedKey) load() (*presharedKeys, error) {
+	if p == nil {
+		return nil, nil
+	}
+	secret, err := misc.Secret{Inline: p.Secret, File: p.SecretFile, Env: p.SecretEnv, Credential: p.SecretCredential}.Resolve()
+	if err != nil {
+		return nil, fmt.Errorf("preshared_key: secret: %s", err)
+	}
+	if secret == "" && p.KeysFile == "" {
+		// an empty block would otherwise leave the handshakes unhardened, unbeknownst to the operator
+		return nil, fmt.Errorf("preshared_key: neither a secret nor a keys_file is set")
+	}
+	if secret != "" && len(secret) < pskMinSecretLen {
+		return nil, fmt.Errorf("preshared_key: secret too short, expecting at least %d bytes", pskMinSecretLen)
+	}
+	keys := &presharedKeys{secret: []byte(secret), explicit: make(map[string]wgtypes.Key)}
+	if p.KeysFile == "" {
+		return keys, nil
+	}
+	data, err := misc.ReadAll(p.KeysFile)
+	if err != nil {
+		return nil, fmt.Errorf("preshared_key: keys_file: %s", err)
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("preshared_key: keys_file: line %d: expecting PUBLIC_KEY PRESHARED_KEY", i+1)
+		}
+		publicKey, err := wgtypes.ParseKey(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("preshared_key: keys_file: line %d: invalid public key: %s", i+1, err)
+		}
+		psk, err := wgtypes.ParseKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("preshared_key: keys_file: line %d: invalid preshared key: %s", i+1, err)
+		}
+		keys.explicit[publicKey.String()] = psk
+	}
+	return keys, nil
+}
+
+// For returns the preshared key between the local and the remote public key, the zero key meaning none
+// wireguard treats the zero key as the absence of a preshared key, so returning it clears a key previously set
+func (k *presharedKeys) For(local, remote wgtypes.Key) wgtypes.Key {
+	if k == nil {
+		return wgtypes.Key{}
+	}
+	if psk, ok := k.explicit[remote.String()]; ok {
+		return psk
+	}
+	if len(k.secret) == 0 {
+		return wgtypes.Key{}
+	}
+	return DerivePresharedKey(k.secret, local, remote)
+}
+
+// DerivePresharedKey derives the preshared key of a pair of nodes from the mesh secret and their public keys
+// the public keys are sorted beforehand, so the result is the same on both sides
+func DerivePresharedKey(secret []byte, a, b wgtypes.Key) wgtypes.Key {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("rait preshared key v1\x00"))
+	mac.Write(a[:])
+	mac.Write(b[:])
+	var psk wgtypes.Key
+	copy(psk[:], mac.Sum(nil))
+	return psk
+}
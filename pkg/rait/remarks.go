@@ -0,0 +1,187 @@
+package rait
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// RemarksValue returns the content of the first remarks block in rait.conf as an object, see BodyValue
+func (r *RAIT) RemarksValue() (cty.Value, error) {
+	content, _, diags := r.Remarks.PartialContent(&hcl.BodySchema{Blocks: []hcl.BlockHeaderSchema{{Type: "remarks"}}})
+	if diags.HasErrors() {
+		return cty.NilVal, diags
+	}
+	blocks := content.Blocks.OfType("remarks")
+	if len(blocks) == 0 {
+		return cty.EmptyObjectVal, nil
+	}
+	return BodyValue(blocks[0].Body, r.evalContext)
+}
+
+// RemarksValue returns the additional attributes and blocks of the peer as an object, see BodyValue
+func (s *Peer) RemarksValue() (cty.Value, error) {
+	if s.Remarks == nil {
+		return cty.EmptyObjectVal, nil
+	}
+	return BodyValue(s.Remarks, s.evalContext)
+}
+
+// BodyValue evaluates a free form body into an object, attributes become attributes of the object
+// and blocks become nested objects, keyed by their labels if any
+// a block type appearing more than once without labels becomes a list of objects
+func BodyValue(body hcl.Body, ctx *hcl.EvalContext) (cty.Value, error) {
+	var diags hcl.Diagnostics
+	var attrs hcl.Attributes
+	result := map[string]cty.Value{}
+
+	// in native syntax, the attributes and blocks hidden by the schema the body was decoded with
+	// are still present in the body, so the content is always retrieved with a schema
+	if syntaxBody, ok := body.(*hclsyntax.Body); ok {
+		schema := &hcl.BodySchema{}
+		for name := range syntaxBody.Attributes {
+			schema.Attributes = append(schema.Attributes, hcl.AttributeSchema{Name: name})
+		}
+		seen := map[string]bool{}
+		for _, block := range syntaxBody.Blocks {
+			if !seen[block.Type] {
+				seen[block.Type] = true
+				labelNames := make([]string, len(block.Labels))
+				for i := range labelNames {
+					labelNames[i] = fmt.Sprintf("label%d", i)
+				}
+				schema.Blocks = append(schema.Blocks, hcl.BlockHeaderSchema{Type: block.Type, LabelNames: labelNames})
+			}
+		}
+		content, _, contentDiags := body.PartialContent(schema)
+		diags = append(diags, contentDiags...)
+		attrs = content.Attributes
+
+		for _, blockSchema := range schema.Blocks {
+			blocks := content.Blocks.OfType(blockSchema.Type)
+			if len(blocks) == 0 {
+				continue // hidden by the schema the body was decoded with
+			}
+			values := make([]cty.Value, 0, len(blocks))
+			keyed := map[string]cty.Value{}
+			for _, block := range blocks {
+				value, err := BodyValue(block.Body, ctx)
+				if err != nil {
+					return cty.NilVal, err
+				}
+				for i := len(block.Labels) - 1; i > 0; i-- {
+					value = cty.ObjectVal(map[string]cty.Value{block.Labels[i]: value})
+				}
+				if len(block.Labels) == 0 {
+					values = append(values, value)
+				} else {
+					keyed = mergeObjects(keyed, block.Labels[0], value)
+				}
+			}
+			switch {
+			case len(keyed) != 0:
+				result[blockSchema.Type] = cty.ObjectVal(keyed)
+			case len(values) == 1:
+				result[blockSchema.Type] = values[0]
+			default:
+				result[blockSchema.Type] = cty.TupleVal(values)
+			}
+		}
+	} else {
+		var attrDiags hcl.Diagnostics
+		attrs, attrDiags = body.JustAttributes()
+		diags = append(diags, attrDiags...)
+	}
+
+	for name, attr := range attrs {
+		value, valueDiags := attr.Expr.Value(ctx)
+		diags = append(diags, valueDiags...)
+		result[name] = value
+	}
+	if diags.HasErrors() {
+		return cty.NilVal, diags
+	}
+	return cty.ObjectVal(result), nil
+}
+
+// mergeObjects sets key in objects to value, merging the attributes if both are objects
+func mergeObjects(objects map[string]cty.Value, key string, value cty.Value) map[string]cty.Value {
+	existing, ok := objects[key]
+	if ok && existing.Type().IsObjectType() && value.Type().IsObjectType() {
+		merged := existing.AsValueMap()
+		for k, v := range value.AsValueMap() {
+			merged = mergeObjects(merged, k, v)
+		}
+		value = cty.ObjectVal(merged)
+	}
+	objects[key] = value
+	return objects
+}
+
+// QueryValue looks up the dotted path in value, where each component is an attribute name or a list index
+// the second return value tells whether the path exists
+func QueryValue(value cty.Value, path string) (cty.Value, bool, error) {
+	if path == "" {
+		return value, true, nil
+	}
+	for _, step := range strings.Split(path, ".") {
+		if value.IsNull() {
+			return cty.NilVal, false, nil
+		}
+		if !value.IsKnown() {
+			return cty.NilVal, false, fmt.Errorf("value of %s is unknown", path)
+		}
+		ty := value.Type()
+		switch {
+		case ty.IsObjectType():
+			if !ty.HasAttribute(step) {
+				return cty.NilVal, false, nil
+			}
+			value = value.GetAttr(step)
+		case ty.IsMapType():
+			key := cty.StringVal(step)
+			if value.HasIndex(key).False() {
+				return cty.NilVal, false, nil
+			}
+			value = value.Index(key)
+		case ty.IsListType() || ty.IsTupleType():
+			index, err := strconv.Atoi(step)
+			if err != nil {
+				return cty.NilVal, false, fmt.Errorf("invalid list index %s in %s", step, path)
+			}
+			key := cty.NumberIntVal(int64(index))
+			if index < 0 || value.HasIndex(key).False() {
+				return cty.NilVal, false, nil
+			}
+			value = value.Index(key)
+		default:
+			return cty.NilVal, false, fmt.Errorf("can not look up %s in %s value of %s", step, ty.FriendlyName(), path)
+		}
+	}
+	return value, true, nil
+}
+
+// FormatValue renders value for human consumption, strings, numbers and booleans are printed as is
+// while other values, or all values if asJSON is set, are rendered as json
+func FormatValue(value cty.Value, asJSON bool) (string, error) {
+	if !asJSON && value.IsKnown() && !value.IsNull() {
+		switch value.Type() {
+		case cty.String:
+			return value.AsString(), nil
+		case cty.Number:
+			return value.AsBigFloat().Text('f', -1), nil
+		case cty.Bool:
+			return strconv.FormatBool(value.True()), nil
+		}
+	}
+	data, err := ctyjson.Marshal(value, value.Type())
+	if err != nil {
+		return "", fmt.Errorf("failed to render value: %s", err)
+	}
+	return string(data), nil
+}
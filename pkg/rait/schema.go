@@ -0,0 +1,35 @@
+package rait
+
+import (
+	"github.com/Catofes/RAIT/v4/pkg/misc"
+)
+
+// ConfSchema returns the json schema of rait.conf in json syntax
+func ConfSchema() map[string]interface{} {
+	schema := misc.JSONSchema(&RAIT{})
+	schema["title"] = "rait.conf"
+	properties := schema["properties"].(map[string]interface{})
+	// see misc.DecodeBody, peer lists are decoded without them
+	properties["variables"] = map[string]interface{}{"type": "object"}
+	properties["locals"] = map[string]interface{}{"type": "object"}
+	// see misc.LoadHCL
+	properties["include"] = map[string]interface{}{
+		"type":  "array",
+		"items": map[string]interface{}{"type": "string"},
+	}
+	// see RAIT.PeerSources
+	properties["peers"] = map[string]interface{}{
+		"oneOf": []interface{}{
+			map[string]interface{}{"type": "string"},
+			map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		},
+	}
+	return schema
+}
+
+// PeersSchema returns the json schema of peer lists in json syntax
+func PeersSchema() map[string]interface{} {
+	schema := misc.JSONSchema(&Peers{})
+	schema["title"] = "peers"
+	return schema
+}
@@ -0,0 +1,90 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/Catofes/RAIT/v4/pkg/misc"
+)
+
+// Client submits the node record to a registry, see Server
+type Client struct {
+	URL    string // the endpoint accepting node records, e.g. https://registry.example/nodes
+	Token  string // the bearer token, sent if not empty
+	Method string // PUT or POST, PUT if empty
+	State  string // file keeping the hash of the last record accepted, so that an unchanged record is not pushed again, disabled if empty
+}
+
+// Push submits record unless it is unchanged since the last accepted push, or force is set
+// the verdicts of the registry are returned, or nil if the push is skipped
+func (c *Client) Push(record []byte, force bool) ([]Verdict, error) {
+	hash := c.hash(record)
+	if !force && c.State != "" {
+		if last, err := ioutil.ReadFile(c.State); err == nil && strings.TrimSpace(string(last)) == hash {
+			return nil, nil
+		}
+	}
+
+	method := c.Method
+	if method == "" {
+		method = http.MethodPut
+	}
+	req, err := http.NewRequest(method, c.URL, bytes.NewReader(record))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := misc.DefaultFetcher.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to push to %s: %s", c.URL, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the response of %s: %s", c.URL, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("push to %s rejected: %s: %s", c.URL, resp.Status, rejection(body))
+	}
+
+	var verdicts []Verdict
+	if err := json.Unmarshal(body, &verdicts); err != nil {
+		return nil, fmt.Errorf("unexpected response of %s: %s", c.URL, err)
+	}
+	if c.State != "" {
+		if err := misc.WriteFileAtomic(c.State, []byte(hash+"\n"), 0644); err != nil {
+			return verdicts, fmt.Errorf("failed to save push state %s: %s", c.State, err)
+		}
+	}
+	return verdicts, nil
+}
+
+// hash identifies the record pushed to the url, so that a change of either triggers a push
+func (c *Client) hash(record []byte) string {
+	sum := sha256.Sum256(append([]byte(c.URL+"\n"), record...))
+	return hex.EncodeToString(sum[:])
+}
+
+// rejection extracts the reason of a rejection from the error response of Server, falling back to the raw body
+func rejection(body []byte) string {
+	var reply struct {
+		Message string   `json:"message"`
+		Errors  []string `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &reply); err != nil || reply.Message == "" {
+		return strings.TrimSpace(string(body))
+	}
+	if len(reply.Errors) != 0 {
+		return reply.Message + ": " + strings.Join(reply.Errors, "; ")
+	}
+	return reply.Message
+}
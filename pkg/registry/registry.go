@@ -0,0 +1,314 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/Catofes/RAIT/v4/pkg/misc"
+	"github.com/Catofes/RAIT/v4/pkg/rait"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+)
+
+// Node is a node record accepted by the registry, as published by RAIT.PublicConf
+type Node struct {
+	PublicKey string          `json:"public_key"`
+	NodeID    string          `json:"node_id,omitempty"`
+	Name      string          `json:"name"`
+	NotBefore string          `json:"not_before,omitempty"`
+	NotAfter  string          `json:"not_after,omitempty"`
+	Endpoint  []rait.Endpoint `json:"endpoint"`
+	Approved  bool            `json:"approved"` // only the approved nodes are served in the peer list
+	Owner     string          `json:"owner"`    // hash of the token the node is first submitted with, see TokenID
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// Verdict is the outcome of submitting a single node record
+type Verdict struct {
+	PublicKey string `json:"public_key"`
+	Name      string `json:"name"`
+	Status    string `json:"status"` // created, updated or unchanged
+	Approved  bool   `json:"approved"`
+}
+
+// the verdict statuses, see Verdict
+const (
+	StatusCreated   = "created"
+	StatusUpdated   = "updated"
+	StatusUnchanged = "unchanged"
+)
+
+// ErrForbidden is returned when a node record is submitted with a token not allowed to, see Submit
+var ErrForbidden = fmt.Errorf("forbidden")
+
+// ErrNotFound is returned when a node is not in the registry
+var ErrNotFound = fmt.Errorf("node not found")
+
+type state struct {
+	Nodes   []*Node  `json:"nodes"`
+	Revoked []string `json:"revoked"` // public keys removed with revocation, served in the revoked list
+}
+
+// Registry keeps the node records in a json file, rendering the approved ones into a peer list
+type Registry struct {
+	path        string
+	autoApprove bool
+
+	mu       sync.Mutex
+	state    state
+	rendered []byte    // the peer list, rendered on every change
+	modified time.Time // time of the last change, served as Last-Modified
+}
+
+// Open loads the registry from path, which is created on the first change if missing
+// nodes submitted for the first time are approved right away if autoApprove is set, otherwise they wait for Approve
+func Open(path string, autoApprove bool) (*Registry, error) {
+	r := &Registry{path: path, autoApprove: autoApprove, modified: time.Now()}
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read registry %s: %s", path, err)
+	default:
+		if err := json.Unmarshal(data, &r.state); err != nil {
+			return nil, fmt.Errorf("failed to parse registry %s: %s", path, err)
+		}
+		if info, err := os.Stat(path); err == nil {
+			r.modified = info.ModTime()
+		}
+	}
+	r.render()
+	return r, nil
+}
+
+// TokenID returns the identity of token as kept in the registry, the token itself is never persisted
+func TokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Decode parses node records in hcl or json, as written by RAIT.PublicConf, and validates them, see rait.Peers.Validate
+// the records are decoded without any evaluation context, so that a submission can not read the files or the environment of the server
+func Decode(data []byte) ([]rait.Peer, hcl.Diagnostics) {
+	file, diags := misc.ParseHCL("node.hcl", data)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	peers := &rait.Peers{}
+	diags = append(diags, gohcl.DecodeBody(file.Body, nil, peers)...)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	diags = append(diags, peers.Validate(file.Body)...)
+	if len(peers.Revoked) != 0 {
+		diags = append(diags, &hcl.Diagnostic{Severity: hcl.DiagError, Summary: "revoked is not accepted in node records"})
+	}
+	if len(peers.Peers) == 0 {
+		diags = append(diags, &hcl.Diagnostic{Severity: hcl.DiagError, Summary: "no node record found"})
+	}
+	// a record would silently replace the previous one of the same key, as rait pub never writes such records
+	seen := make(map[string]bool)
+	for _, peer := range peers.Peers {
+		if seen[peer.PublicKey] {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate node record",
+				Detail:   fmt.Sprintf("public key %s is listed more than once, its endpoints must be in a single record", peer.PublicKey),
+			})
+		}
+		seen[peer.PublicKey] = true
+	}
+	return peers.Peers, diags
+}
+
+// Submit adds or updates the node records on behalf of the token identified by owner, see TokenID
+// a node may only be updated with the token it is first submitted with, and a revoked node may not come back
+// node_id may only be one of the public keys of the token, or one already used by its nodes,
+// so that a token can not group its records with the nodes of another one, see rait.Peer.Node
+func (r *Registry) Submit(owner string, peers []rait.Peer) ([]Verdict, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, peer := range peers {
+		if node := r.find(peer.PublicKey); node != nil && node.Owner != owner {
+			return nil, fmt.Errorf("%s: %w: node is owned by another token", peer.PublicKey, ErrForbidden)
+		}
+		for _, key := range r.state.Revoked {
+			if key == peer.PublicKey {
+				return nil, fmt.Errorf("%s: node is revoked", peer.PublicKey)
+			}
+		}
+	}
+	nodeIDs := r.nodeIDs(owner)
+	for _, peer := range peers {
+		nodeIDs[peer.PublicKey] = true
+	}
+	for _, peer := range peers {
+		if peer.NodeID != "" && !nodeIDs[peer.NodeID] {
+			return nil, fmt.Errorf("%s: %w: node_id %s is neither a public key nor a node_id of the nodes of this token", peer.PublicKey, ErrForbidden, peer.NodeID)
+		}
+	}
+
+	now := time.Now()
+	changed := false
+	verdicts := make([]Verdict, 0, len(peers))
+	for _, peer := range peers {
+		verdict := Verdict{PublicKey: peer.PublicKey, Name: peer.Name}
+		node := r.find(peer.PublicKey)
+		switch {
+		case node == nil:
+			node = &Node{
+				PublicKey: peer.PublicKey,
+				Approved:  r.autoApprove,
+				Owner:     owner,
+				CreatedAt: now,
+			}
+			r.state.Nodes = append(r.state.Nodes, node)
+			verdict.Status = StatusCreated
+		case node.NodeID == peer.NodeID && node.Name == peer.Name && node.NotBefore == peer.NotBefore && node.NotAfter == peer.NotAfter &&
+			reflect.DeepEqual(node.Endpoint, peer.Endpoint):
+			verdict.Status = StatusUnchanged
+		default:
+			verdict.Status = StatusUpdated
+		}
+		if verdict.Status != StatusUnchanged {
+			node.NodeID, node.Name, node.Endpoint, node.UpdatedAt = peer.NodeID, peer.Name, peer.Endpoint, now
+			node.NotBefore, node.NotAfter = peer.NotBefore, peer.NotAfter
+			changed = true
+		}
+		verdict.Approved = node.Approved
+		verdicts = append(verdicts, verdict)
+	}
+	if changed {
+		if err := r.commit(); err != nil {
+			return nil, err
+		}
+	}
+	return verdicts, nil
+}
+
+// Nodes returns a copy of every node in the registry, approved or not
+func (r *Registry) Nodes() []Node {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	nodes := make([]Node, 0, len(r.state.Nodes))
+	for _, node := range r.state.Nodes {
+		nodes = append(nodes, *node)
+	}
+	return nodes
+}
+
+// Approve marks the node of publicKey as approved, so that it is served in the peer list
+func (r *Registry) Approve(publicKey string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	node := r.find(publicKey)
+	if node == nil {
+		return ErrNotFound
+	}
+	if node.Approved {
+		return nil
+	}
+	node.Approved = true
+	return r.commit()
+}
+
+// Remove deletes the node of publicKey, also listing it as revoked in the peer list if revoke is set
+// revoking works for keys unknown to the registry as well
+func (r *Registry) Remove(publicKey string, revoke bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	found := false
+	n := 0
+	for _, node := range r.state.Nodes {
+		if node.PublicKey == publicKey {
+			found = true
+			continue
+		}
+		r.state.Nodes[n] = node
+		n++
+	}
+	r.state.Nodes = r.state.Nodes[:n]
+	if revoke {
+		for _, key := range r.state.Revoked {
+			if key == publicKey {
+				revoke = false
+			}
+		}
+		if revoke {
+			r.state.Revoked = append(r.state.Revoked, publicKey)
+		}
+	}
+	if !found && !revoke {
+		return ErrNotFound
+	}
+	return r.commit()
+}
+
+// PeerList returns the peer list of the approved nodes with the time of its last change
+func (r *Registry) PeerList() ([]byte, time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rendered, r.modified
+}
+
+// nodeIDs returns the public keys and the node ids of the nodes of owner
+func (r *Registry) nodeIDs(owner string) map[string]bool {
+	ids := make(map[string]bool)
+	for _, node := range r.state.Nodes {
+		if node.Owner == owner {
+			ids[node.PublicKey] = true
+			if node.NodeID != "" {
+				ids[node.NodeID] = true
+			}
+		}
+	}
+	return ids
+}
+
+func (r *Registry) find(publicKey string) *Node {
+	for _, node := range r.state.Nodes {
+		if node.PublicKey == publicKey {
+			return node
+		}
+	}
+	return nil
+}
+
+// commit persists the state and renders the peer list again, it must be called with mu held
+func (r *Registry) commit() error {
+	data, err := json.MarshalIndent(&r.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := misc.WriteFileAtomic(r.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save registry %s: %s", r.path, err)
+	}
+	r.modified = time.Now()
+	r.render()
+	return nil
+}
+
+func (r *Registry) render() {
+	peers := rait.Peers{Revoked: r.state.Revoked, Peers: make([]rait.Peer, 0)}
+	for _, node := range r.state.Nodes {
+		if node.Approved {
+			peers.Peers = append(peers.Peers, rait.Peer{
+				PublicKey: node.PublicKey,
+				NodeID:    node.NodeID,
+				Name:      node.Name,
+				NotBefore: node.NotBefore,
+				NotAfter:  node.NotAfter,
+				Endpoint:  node.Endpoint,
+			})
+		}
+	}
+	r.rendered = misc.EncodeHCL(&peers).Bytes()
+}
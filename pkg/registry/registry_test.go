@@ -0,0 +1,129 @@
+package registry
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Catofes/RAIT/v4/pkg/rait"
+)
+
+const (
+	testKey1 = "5q1HDxrH29mQGy/CIhHtNEOn+6LRxh9HeJzQQeFTEVc="
+	testKey2 = "mJJTOxyEMf3ofN9imDCR1HLaH8b/wMgwFYJaN5yRUng="
+	testKey3 = "rCOdBo/2sZlbwqTnOs8XiHbzwBI6+FVmgHNG5ZNdLmI="
+)
+
+func testPeer(publicKey, nodeID, name string) rait.Peer {
+	return rait.Peer{
+		PublicKey: publicKey,
+		NodeID:    nodeID,
+		Name:      name,
+		Endpoint:  []rait.Endpoint{{AddressFamily: "ip4", Port: 1}},
+	}
+}
+
+// openTestRegistry opens a registry where owner a has submitted testKey1, and testKey3 is revoked
+func openTestRegistry(t *testing.T) *Registry {
+	dir, err := ioutil.TempDir("", "rait-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	r, err := Open(filepath.Join(dir, "registry.json"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Submit("a", []rait.Peer{testPeer(testKey1, "", "one")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Remove(testKey3, true); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestSubmit(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		owner     string
+		peers     []rait.Peer
+		forbidden bool
+		err       string // expected in the error if not empty
+		status    string // expected status of the first verdict if no error
+	}{
+		{"unchanged resubmission", "a", []rait.Peer{testPeer(testKey1, "", "one")}, false, "", StatusUnchanged},
+		{"update", "a", []rait.Peer{testPeer(testKey1, "", "uno")}, false, "", StatusUpdated},
+		{"new node", "b", []rait.Peer{testPeer(testKey2, "", "two")}, false, "", StatusCreated},
+		{"foreign owner", "b", []rait.Peer{testPeer(testKey1, "", "one")}, true, "owned by another token", ""},
+		{"revoked key", "a", []rait.Peer{testPeer(testKey3, "", "three")}, false, "revoked", ""},
+		{"node_id of another token", "b", []rait.Peer{testPeer(testKey2, testKey1, "two")}, true, "node_id", ""},
+		{"node_id unknown", "a", []rait.Peer{testPeer(testKey2, "node-1.example", "two")}, true, "node_id", ""},
+		{"node_id of its own node", "a", []rait.Peer{testPeer(testKey2, testKey1, "one")}, false, "", StatusCreated},
+		{"node_id of the same submission", "b", []rait.Peer{testPeer(testKey2, "", "two"), testPeer("GMi1N+CAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", testKey2, "two")}, false, "", StatusCreated},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			r := openTestRegistry(t)
+			verdicts, err := r.Submit(c.owner, c.peers)
+			if c.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if verdicts[0].Status != c.status {
+					t.Errorf("status %s, want %s", verdicts[0].Status, c.status)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expecting an error containing %q", c.err)
+			}
+			if !strings.Contains(err.Error(), c.err) {
+				t.Errorf("error %q does not contain %q", err, c.err)
+			}
+			if errors.Is(err, ErrForbidden) != c.forbidden {
+				t.Errorf("error %q: forbidden is %t, want %t", err, !c.forbidden, c.forbidden)
+			}
+		})
+	}
+}
+
+func TestSubmitValidity(t *testing.T) {
+	r := openTestRegistry(t)
+	peer := testPeer(testKey1, "", "one")
+	peer.NotAfter = "2030-01-01T00:00:00Z"
+	verdicts, err := r.Submit("a", []rait.Peer{peer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verdicts[0].Status != StatusUpdated {
+		t.Errorf("status %s, want %s", verdicts[0].Status, StatusUpdated)
+	}
+	data, _ := r.PeerList()
+	if !strings.Contains(string(data), `not_after  = "2030-01-01T00:00:00Z"`) {
+		t.Errorf("not_after missing in the peer list:\n%s", data)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	record := `
+peers {
+  public_key = "` + testKey1 + `"
+  endpoint {
+    address_family = "ip4"
+    port           = 1
+  }
+}
+`
+	if _, diags := Decode([]byte(record)); diags.HasErrors() {
+		t.Errorf("unexpected error: %s", diags)
+	}
+	if _, diags := Decode([]byte(record + record)); !diags.HasErrors() {
+		t.Errorf("expecting an error for records of the same key")
+	}
+	if _, diags := Decode([]byte(strings.Replace(record, `port           = 1`, `port           = env("HOME")`, 1))); !diags.HasErrors() {
+		t.Errorf("expecting an error for a function call")
+	}
+}
@@ -0,0 +1,219 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Catofes/RAIT/v4/pkg/misc"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// maxRecordSize bounds the size of a submitted node record
+const maxRecordSize = 1 << 20
+
+// Server serves a Registry over http:
+//
+//	GET    /peers.conf                    the peer list, with its detached signature at /peers.conf.sig if SigningKey is set
+//	PUT    /nodes                         submit node records, authenticated by a node token, POST is accepted as well
+//	GET    /admin/nodes                   list every node, authenticated by an admin token
+//	POST   /admin/nodes/:key/approve      approve a node
+//	DELETE /admin/nodes/:key[?revoke=1]   remove a node, also revoking its key if asked to
+//
+// the public keys in the paths are url encoded, e.g. with / as %2F
+type Server struct {
+	Registry    *Registry
+	NodeTokens  []string // tokens accepted for submitting node records
+	AdminTokens []string // tokens accepted for the admin endpoints
+	SigningKey  string   // secret key generated by rait registry keygen, the peer list is not signed if empty
+
+	mu        sync.Mutex
+	signed    []byte // the peer list the signature is made for
+	signature []byte
+}
+
+// ReadTokens reads the tokens at path, one per line, ignoring empty lines and comments starting with #
+func ReadTokens(path string) ([]string, error) {
+	data, err := misc.ReadAll(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			tokens = append(tokens, line)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no token found in %s", path)
+	}
+	return tokens, nil
+}
+
+// Echo returns the echo instance serving the registry
+func (s *Server) Echo() *echo.Echo {
+	e := echo.New()
+	e.HideBanner = true
+	e.Use(middleware.Logger())
+	e.Use(middleware.Recover())
+	e.GET("/peers.conf", s.getPeers)
+	if s.SigningKey != "" {
+		e.GET("/peers.conf.sig", s.getSignature)
+	}
+	e.PUT("/nodes", s.putNodes, s.auth(s.NodeTokens))
+	e.POST("/nodes", s.putNodes, s.auth(s.NodeTokens))
+	admin := e.Group("/admin", s.auth(s.AdminTokens))
+	admin.GET("/nodes", s.listNodes)
+	admin.POST("/nodes/:key/approve", s.approveNode)
+	admin.DELETE("/nodes/:key", s.removeNode)
+	return e
+}
+
+// ListenAndServe serves the registry at address, in the form of host:port
+func (s *Server) ListenAndServe(address string) error {
+	if s.SigningKey != "" {
+		// fail early on an invalid key rather than on the first request
+		if _, err := misc.Sign(s.SigningKey, nil); err != nil {
+			return err
+		}
+	}
+	return s.Echo().Start(address)
+}
+
+// auth accepts the requests bearing one of tokens, keeping the identity of the token as "token" in the context
+func (s *Server) auth(tokens []string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			header := ctx.Request().Header.Get(echo.HeaderAuthorization)
+			if strings.HasPrefix(header, "Bearer ") {
+				// compare the hashes in constant time, so that neither the length nor the content of tokens leaks
+				given := sha256.Sum256([]byte(strings.TrimPrefix(header, "Bearer ")))
+				for _, token := range tokens {
+					expected := sha256.Sum256([]byte(token))
+					if subtle.ConstantTimeCompare(given[:], expected[:]) == 1 {
+						ctx.Set("token", TokenID(token))
+						return next(ctx)
+					}
+				}
+			}
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid or missing bearer token")
+		}
+	}
+}
+
+func (s *Server) getPeers(ctx echo.Context) error {
+	data, modified := s.Registry.PeerList()
+	return serveConditional(ctx, data, modified)
+}
+
+func (s *Server) getSignature(ctx echo.Context) error {
+	data, modified := s.Registry.PeerList()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.signature == nil || string(s.signed) != string(data) {
+		signature, err := misc.Sign(s.SigningKey, data)
+		if err != nil {
+			return err
+		}
+		s.signed, s.signature = data, signature
+	}
+	return serveConditional(ctx, s.signature, modified)
+}
+
+// serveConditional serves data with an ETag and a Last-Modified header, replying 304 to requests already holding it
+func serveConditional(ctx echo.Context, data []byte, modified time.Time) error {
+	sum := sha256.Sum256(data)
+	etag := fmt.Sprintf(`"%x"`, sum[:16])
+	header := ctx.Response().Header()
+	header.Set("ETag", etag)
+	header.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	header.Set("Cache-Control", "no-cache")
+
+	req := ctx.Request()
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return ctx.NoContent(http.StatusNotModified)
+			}
+		}
+	} else if since, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil && !modified.Truncate(time.Second).After(since) {
+		return ctx.NoContent(http.StatusNotModified)
+	}
+	return ctx.Blob(http.StatusOK, "text/plain; charset=utf-8", data)
+}
+
+func (s *Server) putNodes(ctx echo.Context) error {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(ctx.Response(), ctx.Request().Body, maxRecordSize))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("failed to read node records: %s", err))
+	}
+	peers, diags := Decode(data)
+	if diags.HasErrors() {
+		messages := make([]string, 0, len(diags))
+		for _, diag := range diags {
+			messages = append(messages, misc.FormatDiagnostic(diag))
+		}
+		return ctx.JSON(http.StatusBadRequest, map[string]interface{}{"message": "invalid node records", "errors": messages})
+	}
+	verdicts, err := s.Registry.Submit(ctx.Get("token").(string), peers)
+	if errors.Is(err, ErrForbidden) {
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	for _, verdict := range verdicts {
+		zap.S().Infof("node %s %s %s, approved: %t", verdict.Name, verdict.PublicKey, verdict.Status, verdict.Approved)
+	}
+	return ctx.JSON(http.StatusOK, verdicts)
+}
+
+func (s *Server) listNodes(ctx echo.Context) error {
+	return ctx.JSON(http.StatusOK, s.Registry.Nodes())
+}
+
+func (s *Server) approveNode(ctx echo.Context) error {
+	key, err := url.PathUnescape(ctx.Param("key"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := s.Registry.Approve(key); err != nil {
+		return registryError(err)
+	}
+	zap.S().Infof("node %s approved", key)
+	return ctx.NoContent(http.StatusNoContent)
+}
+
+func (s *Server) removeNode(ctx echo.Context) error {
+	key, err := url.PathUnescape(ctx.Param("key"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	revoke := ctx.QueryParam("revoke") == "1" || ctx.QueryParam("revoke") == "true"
+	if _, err := wgtypes.ParseKey(key); revoke && err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid public key: %s", err))
+	}
+	if err := s.Registry.Remove(key, revoke); err != nil {
+		return registryError(err)
+	}
+	zap.S().Infof("node %s removed, revoked: %t", key, revoke)
+	return ctx.NoContent(http.StatusNoContent)
+}
+
+func registryError(err error) error {
+	if errors.Is(err, ErrNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return err
+}